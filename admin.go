@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"git.meow.tf/ow-api/ow-api/cache"
+	"github.com/julienschmidt/httprouter"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUnauthorized    = errors.New("unauthorized")
+	errInvalidPlatform = errors.New("invalid platform")
+	errNotWatched      = errors.New("player is not watched")
+
+	// heroesNotPurgedOnce logs providers unable to purge hero responses only once
+	heroesNotPurgedOnce sync.Once
+)
+
+func registerAdmin(router *labelledRouter) {
+	router.GET("/admin/cache/:platform/:tag", requireAdmin(adminCacheEntries))
+	router.DELETE("/admin/cache/:platform/:tag", requireAdmin(adminPurgeCache))
+	router.POST("/admin/cache/:platform/:tag/refresh", requireAdmin(adminRefreshCache))
+
+	router.GET("/admin/watchlist", requireAdmin(adminWatchlist))
+	router.PUT("/admin/watchlist/:platform/:tag", requireAdmin(adminWatchPlayer))
+	router.DELETE("/admin/watchlist/:platform/:tag", requireAdmin(adminUnwatchPlayer))
+
+	if apiKeys != nil {
+		router.GET("/admin/keys", requireAdmin(adminListKeys))
+		router.POST("/admin/keys", requireAdmin(adminCreateKey))
+		router.GET("/admin/keys/:id", requireAdmin(adminGetKey))
+		router.DELETE("/admin/keys/:id", requireAdmin(adminRevokeKey))
+		router.POST("/admin/keys/:id/rotate", requireAdmin(adminRotateKey))
+	}
+}
+
+// requireAdmin only calls handler for requests carrying the admin token as a bearer token.
+func requireAdmin(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeErrorStatus(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+
+		if platform := ps.ByName("platform"); platform != "" && !validPlatform(platform) {
+			writeErrorStatus(w, http.StatusBadRequest, errInvalidPlatform)
+			return
+		}
+
+		// Tags are looked up in their URL form, as the public routes cache them
+		if ps.ByName("tag") != "" && !validTag(normalizeTagParam(ps)) {
+			writeError(w, errInvalidTag)
+			return
+		}
+
+		handler(w, r, ps)
+	}
+}
+
+func validPlatform(platform string) bool {
+	for _, p := range platforms {
+		if p == platform {
+			return true
+		}
+	}
+
+	return false
+}
+
+type adminEntry struct {
+	Key        string     `json:"key"`
+	Version    string     `json:"version"`
+	Kind       string     `json:"kind,omitempty"`
+	Size       int        `json:"size"`
+	TTL        int64      `json:"ttl"`
+	Fresh      bool       `json:"fresh"`
+	FreshUntil *time.Time `json:"freshUntil,omitempty"`
+	StaleUntil *time.Time `json:"staleUntil,omitempty"`
+}
+
+type adminEntriesObject struct {
+	Platform string       `json:"platform"`
+	Tag      string       `json:"tag"`
+	Entries  []adminEntry `json:"entries"`
+}
+
+// adminPurgeObject is the result of a purge. HeroesPurged is false when the cache provider can't purge
+// hero responses, which are then kept until they expire.
+type adminPurgeObject struct {
+	Deleted      int  `json:"deleted"`
+	HeroesPurged bool `json:"heroesPurged"`
+}
+
+// adminKeyObject describes an api key, with its secret only when it was just created or rotated.
+type adminKeyObject struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name"`
+	Tier    string           `json:"tier"`
+	Routes  []string         `json:"routes,omitempty"`
+	Created time.Time        `json:"created"`
+	Rotated *time.Time       `json:"rotated,omitempty"`
+	Usage   map[string]int64 `json:"usage,omitempty"`
+	Key     string           `json:"key,omitempty"`
+}
+
+type adminKeysObject struct {
+	Keys []adminKeyObject `json:"keys"`
+}
+
+type adminKeyRequest struct {
+	Name   string   `json:"name"`
+	Tier   string   `json:"tier"`
+	Routes []string `json:"routes"`
+}
+
+func newAdminKeyObject(k *apiKey, secret string) adminKeyObject {
+	return adminKeyObject{
+		ID:      k.ID,
+		Name:    k.Name,
+		Tier:    k.Tier,
+		Routes:  k.Routes,
+		Created: k.Created,
+		Rotated: k.Rotated,
+		Usage:   k.Usage,
+		Key:     secret,
+	}
+}
+
+// writeKeyError writes err with the status matching the api key errors.
+func writeKeyError(w http.ResponseWriter, err error) {
+	switch err {
+	case errKeyNotFound:
+		writeErrorStatus(w, http.StatusNotFound, err)
+	case errUnknownTier, errNoKeyName:
+		writeErrorStatus(w, http.StatusBadRequest, err)
+	case cache.ErrNotSupported:
+		writeErrorStatus(w, http.StatusNotImplemented, err)
+	default:
+		writeErrorStatus(w, http.StatusInternalServerError, err)
+	}
+}
+
+type adminWatchlistObject struct {
+	Players []watchedPlayer `json:"players"`
+}
+
+// playerCacheKeys returns the keys of the full and filtered responses cached for a player and api version.
+// Hero filtered responses are only listed when the provider supports listing keys.
+func playerCacheKeys(version ApiVersion, platform, tag string) ([]string, error) {
+	key := cacheKey(version, platform, tag)
+
+	heroKeys, err := cacheProvider.Keys(key + "-heroes-")
+
+	if err != nil && err != cache.ErrNotSupported {
+		return nil, err
+	}
+
+	return append([]string{key, key + "-profile"}, heroKeys...), nil
+}
+
+// purgeFilteredEntries removes the profile and hero responses created from the full response cached under key,
+// reporting whether the hero responses were removed. Providers unable to purge by prefix keep them until they expire.
+func purgeFilteredEntries(key string) (bool, error) {
+	if err := cacheProvider.Delete(key + "-profile"); err != nil {
+		return false, err
+	}
+
+	if _, err := cacheProvider.Purge(key + "-heroes-"); err == cache.ErrNotSupported {
+		heroesNotPurgedOnce.Do(func() {
+			slog.Info("The cache provider can't purge hero responses, they are kept until they expire")
+		})
+
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func adminCacheEntries(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	platform, tag := ps.ByName("platform"), ps.ByName("tag")
+
+	res := &adminEntriesObject{Platform: platform, Tag: tag, Entries: make([]adminEntry, 0)}
+
+	now := time.Now()
+
+	for _, version := range apiVersions {
+		keys, err := playerCacheKeys(version, platform, tag)
+
+		if err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		values, err := cacheProvider.GetMulti(keys)
+
+		if err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		for _, key := range keys {
+			b, exists := values[key]
+
+			if !exists {
+				continue
+			}
+
+			ttl, err := cacheProvider.TTL(key)
+
+			if err != nil {
+				continue
+			}
+
+			entry, err := cache.DecodeEntry(b)
+
+			if err != nil {
+				continue
+			}
+
+			e := adminEntry{
+				Key:     key,
+				Version: apiVersionName(version),
+				Kind:    entry.Kind,
+				Size:    len(entry.Data),
+				TTL:     int64(ttl / time.Second),
+				Fresh:   entry.Fresh(now),
+			}
+
+			if !entry.FreshUntil.IsZero() {
+				e.FreshUntil, e.StaleUntil = &entry.FreshUntil, &entry.StaleUntil
+			}
+
+			res.Entries = append(res.Entries, e)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+func adminPurgeCache(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	platform, tag := ps.ByName("platform"), ps.ByName("tag")
+
+	res := &adminPurgeObject{}
+
+	for _, version := range apiVersions {
+		keys, err := playerCacheKeys(version, platform, tag)
+
+		if err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		values, err := cacheProvider.GetMulti(keys)
+
+		if err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		for key := range values {
+			if err := cacheProvider.Delete(key); err != nil {
+				writeErrorStatus(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			res.Deleted++
+		}
+
+		// Hero responses can't be listed on every provider, so purge them by prefix as well
+		purged, err := purgeFilteredEntries(cacheKey(version, platform, tag))
+
+		if err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		res.HeroesPurged = purged
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+func adminRefreshCache(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := refreshStats(r.Context(), ps.ByName("platform"), ps.ByName("tag")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	adminCacheEntries(w, r, ps)
+}
+
+func adminWatchlist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(&adminWatchlistObject{Players: watchedPlayers.Players()})
+}
+
+func adminWatchPlayer(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	platform, tag := ps.ByName("platform"), ps.ByName("tag")
+
+	added, err := watchedPlayers.Add(platform, tag)
+
+	if err != nil {
+		writeErrorStatus(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if added {
+		// Warm the new player right away instead of waiting for the next scheduled refresh,
+		// failures are reported through the player's last error
+		watchedPlayers.refresh(r.Context(), platform, tag)
+
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	json.NewEncoder(w).Encode(&adminWatchlistObject{Players: watchedPlayers.Players()})
+}
+
+func adminUnwatchPlayer(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	removed, err := watchedPlayers.Remove(ps.ByName("platform"), ps.ByName("tag"))
+
+	if err != nil {
+		writeErrorStatus(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !removed {
+		writeErrorStatus(w, http.StatusNotFound, errNotWatched)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(&adminWatchlistObject{Players: watchedPlayers.Players()})
+}
+
+func adminListKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	keys, err := apiKeys.store.List()
+
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	res := &adminKeysObject{Keys: make([]adminKeyObject, len(keys))}
+
+	for i, k := range keys {
+		res.Keys[i] = newAdminKeyObject(k, "")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+func adminCreateKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req adminKeyRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	k, secret, err := apiKeys.Create(req.Name, req.Tier, req.Routes)
+
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(newAdminKeyObject(k, secret))
+}
+
+func adminGetKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	k, err := apiKeys.Get(ps.ByName("id"))
+
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(newAdminKeyObject(k, ""))
+}
+
+func adminRotateKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	k, secret, err := apiKeys.Rotate(ps.ByName("id"))
+
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(newAdminKeyObject(k, secret))
+}
+
+func adminRevokeKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := apiKeys.Revoke(ps.ByName("id")); err != nil {
+		writeKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"git.meow.tf/ow-api/ow-api/cache"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, method, url, token string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if v != nil && res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return res.StatusCode
+}
+
+func Test_AdminCache(t *testing.T) {
+	_, fetcher := setupTestServer(t)
+
+	oldToken := adminToken
+	adminToken = "secret"
+
+	defer func() {
+		adminToken = oldToken
+	}()
+
+	cacheProvider = newTestCache(t, "gcache://?size=64")
+	cacheTime = time.Minute
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	getJSON(t, srv.URL+"/v2/stats/pc/cats-11481/profile", http.StatusOK)
+	getJSON(t, srv.URL+"/v3/stats/pc/cats-11481/heroes/ana", http.StatusOK)
+
+	if status := adminRequest(t, http.MethodGet, srv.URL+"/admin/cache/pc/cats-11481", "wrong", nil); status != http.StatusUnauthorized {
+		t.Fatal("Expected unauthorized, got", status)
+	}
+
+	var entries adminEntriesObject
+
+	if status := adminRequest(t, http.MethodGet, srv.URL+"/admin/cache/pc/cats-11481", "secret", &entries); status != http.StatusOK {
+		t.Fatal("Unexpected status", status)
+	}
+
+	// Full and profile responses for v2, full and heroes responses for v3
+	if len(entries.Entries) != 4 {
+		t.Fatal("Expected 4 entries, got", entries.Entries)
+	}
+
+	var purged adminPurgeObject
+
+	// An encoded # purges the same player
+	adminRequest(t, http.MethodDelete, srv.URL+"/admin/cache/pc/cats%2311481", "secret", &purged)
+
+	if purged.Deleted != 4 || !purged.HeroesPurged {
+		t.Fatal("Expected 4 deleted entries and the hero responses purged, got", purged)
+	}
+
+	if status := adminRequest(t, http.MethodPost, srv.URL+"/admin/cache/pc/not%20a%20tag!/refresh", "secret", nil); status != http.StatusBadRequest {
+		t.Fatal("Expected an invalid tag, got", status)
+	}
+
+	calls := fetcher.Calls()
+
+	entries = adminEntriesObject{}
+
+	if status := adminRequest(t, http.MethodPost, srv.URL+"/admin/cache/pc/cats-11481/refresh", "secret", &entries); status != http.StatusOK {
+		t.Fatal("Unexpected status", status)
+	}
+
+	if fetcher.Calls() != calls+1 {
+		t.Fatal("Expected the refresh to fetch the player once")
+	}
+
+	if len(entries.Entries) != len(apiVersions) {
+		t.Fatal("Expected a full response per api version, got", entries.Entries)
+	}
+}
+
+// unpurgeableCache can't list or purge keys by prefix, like memcached.
+type unpurgeableCache struct {
+	cache.Provider
+}
+
+func (c *unpurgeableCache) Keys(prefix string) ([]string, error) {
+	return nil, cache.ErrNotSupported
+}
+
+func (c *unpurgeableCache) Purge(prefix string) (int, error) {
+	return 0, cache.ErrNotSupported
+}
+
+func Test_AdminCacheWithoutPurge(t *testing.T) {
+	setupTestServer(t)
+
+	oldToken := adminToken
+	adminToken = "secret"
+
+	defer func() {
+		adminToken = oldToken
+	}()
+
+	cacheProvider = &unpurgeableCache{Provider: newTestCache(t, "gcache://?size=64")}
+	cacheTime = time.Minute
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	getJSON(t, srv.URL+"/v3/stats/pc/cats-11481/heroes/ana", http.StatusOK)
+
+	var purged adminPurgeObject
+
+	if status := adminRequest(t, http.MethodDelete, srv.URL+"/admin/cache/pc/cats-11481", "secret", &purged); status != http.StatusOK {
+		t.Fatal("Expected the purge to succeed, got", status)
+	}
+
+	if purged.Deleted != 1 || purged.HeroesPurged {
+		t.Fatal("Expected the hero responses to be reported as kept, got", purged)
+	}
+
+	w, _ := newWatchlist("")
+
+	w.Add("pc", "cats-11481")
+
+	if err := w.refresh(context.Background(), "pc", "cats-11481"); err != nil {
+		t.Fatal("Expected the refresh to succeed, got", err)
+	}
+
+	if players := w.Players(); players[0].LastError != "" {
+		t.Fatal("Expected no error to be recorded, got", players[0].LastError)
+	}
+
+	if status := adminRequest(t, http.MethodPost, srv.URL+"/admin/cache/pc/cats-11481/refresh", "secret", nil); status != http.StatusOK {
+		t.Fatal("Expected the refresh to succeed, got", status)
+	}
+
+	if _, err := cacheProvider.Get(cacheKey(VersionThree, "pc", "cats-11481")); err != nil {
+		t.Fatal("Expected the full response to be refreshed anyway, got", err)
+	}
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.meow.tf/ow-api/ow-api/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiKeyPrefix = "owk_"
+
+	// usageMonthFormat is the layout of the months api key usage is recorded by
+	usageMonthFormat = "2006-01"
+)
+
+var (
+	errKeyNotFound = errors.New("api key not found")
+	errUnknownTier = errors.New("unknown tier")
+	errNoKeyName   = errors.New("api key name is required")
+
+	errCacheKeyStore = errors.New("the cache provider may lose api keys, use redis or a file as the api key store")
+
+	apiKeyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "owapi_api_key_requests_total",
+		Help: "Requests made with each api key.",
+	}, []string{"key"})
+)
+
+// apiKey is an api key as stored, identified by the hash of its secret.
+// Routes restricts the key to the listed routes, such as /v3/stats/:platform/:tag/profile,
+// or those starting with a prefix such as /v3/*. Keys without routes may use every route.
+type apiKey struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name"`
+	Tier    string           `json:"tier"`
+	Routes  []string         `json:"routes,omitempty"`
+	Hash    string           `json:"hash"`
+	Created time.Time        `json:"created"`
+	Rotated *time.Time       `json:"rotated,omitempty"`
+	Usage   map[string]int64 `json:"usage,omitempty"`
+}
+
+// allows reports whether the key may be used for route.
+func (k *apiKey) allows(route string) bool {
+	if len(k.Routes) == 0 {
+		return true
+	}
+
+	for _, allowed := range k.Routes {
+		if allowed == route || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(route, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// parseTiers parses a comma separated list of tiers with their requests per minute and burst,
+// such as free=120:30,sponsor=600:100.
+func parseTiers(s string) (map[string]rateLimit, error) {
+	tiers := make(map[string]rateLimit)
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		name, limits, _ := strings.Cut(entry, "=")
+		perMinute, burst, _ := strings.Cut(limits, ":")
+
+		l := rateLimit{}
+
+		var err error
+
+		if l.perMinute, err = strconv.Atoi(perMinute); err != nil || l.perMinute < 0 || name == "" {
+			return nil, fmt.Errorf("invalid tier %q", entry)
+		}
+
+		if l.burst, err = strconv.Atoi(burst); err != nil || l.burst < 1 {
+			return nil, fmt.Errorf("invalid tier %q", entry)
+		}
+
+		tiers[name] = l
+	}
+
+	return tiers, nil
+}
+
+// apiKeyStore persists api keys. Missing keys are reported with errKeyNotFound.
+type apiKeyStore interface {
+	Get(id string) (*apiKey, error)
+	Lookup(hash string) (*apiKey, error)
+
+	// Put stores k, replacing the hash it was stored under before when oldHash is set.
+	Put(k *apiKey, oldHash string) error
+	Delete(k *apiKey) error
+	List() ([]*apiKey, error)
+}
+
+// newAPIKeyStore returns the store for the -apiKeyStore flag, either "cache" to share keys
+// through the cache provider or the path of a local file.
+func newAPIKeyStore(store string) (apiKeyStore, error) {
+	if store == "cache" {
+		return newCacheKeyStore()
+	}
+
+	return newFileKeyStore(store)
+}
+
+// cacheKeyStore stores keys in the cache provider without expiry, so replicas sharing a cache share keys.
+// Only providers keeping keys until deleted are used, see cache.Durable, and keys are read from the shared
+// L2 of tiered providers, so revoked keys stop working on every replica at once.
+type cacheKeyStore struct {
+	provider cache.Provider
+}
+
+// newCacheKeyStore returns a store in the cache provider, or errCacheKeyStore when the provider may lose keys.
+func newCacheKeyStore() (*cacheKeyStore, error) {
+	p := cacheProvider
+
+	if m, ok := p.(*metricsProvider); ok {
+		p = m.Provider
+	}
+
+	if t, ok := p.(*cache.Tiered); ok {
+		p = t.L2()
+	}
+
+	if !cache.Durable(p) {
+		return nil, errCacheKeyStore
+	}
+
+	return &cacheKeyStore{provider: p}, nil
+}
+
+func (s *cacheKeyStore) Get(id string) (*apiKey, error) {
+	b, err := s.provider.Get("apikey-id-" + id)
+
+	if err == cache.ErrNotFound {
+		return nil, errKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	k := &apiKey{}
+
+	if err := json.Unmarshal(b, k); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (s *cacheKeyStore) Lookup(hash string) (*apiKey, error) {
+	id, err := s.provider.Get("apikey-hash-" + hash)
+
+	if err == cache.ErrNotFound {
+		return nil, errKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return s.Get(string(id))
+}
+
+func (s *cacheKeyStore) Put(k *apiKey, oldHash string) error {
+	b, err := json.Marshal(k)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.provider.SetMulti(map[string][]byte{
+		"apikey-id-" + k.ID:     b,
+		"apikey-hash-" + k.Hash: []byte(k.ID),
+	}, 0); err != nil {
+		return err
+	}
+
+	if oldHash != "" && oldHash != k.Hash {
+		return s.provider.Delete("apikey-hash-" + oldHash)
+	}
+
+	return nil
+}
+
+func (s *cacheKeyStore) Delete(k *apiKey) error {
+	if err := s.provider.Delete("apikey-hash-" + k.Hash); err != nil {
+		return err
+	}
+
+	return s.provider.Delete("apikey-id-" + k.ID)
+}
+
+func (s *cacheKeyStore) List() ([]*apiKey, error) {
+	keys, err := s.provider.Keys("apikey-id-")
+
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := s.provider.GetMulti(keys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*apiKey, 0, len(values))
+
+	for _, b := range values {
+		k := &apiKey{}
+
+		if err := json.Unmarshal(b, k); err != nil {
+			return nil, err
+		}
+
+		list = append(list, k)
+	}
+
+	return list, nil
+}
+
+// fileKeyStore keeps keys in memory, saving them as a JSON list to file on every change.
+type fileKeyStore struct {
+	file string
+
+	mu     sync.Mutex
+	keys   map[string]*apiKey
+	byHash map[string]string
+}
+
+func newFileKeyStore(file string) (*fileKeyStore, error) {
+	s := &fileKeyStore{file: file, keys: make(map[string]*apiKey), byHash: make(map[string]string)}
+
+	b, err := os.ReadFile(file)
+
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []*apiKey
+
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	for _, k := range list {
+		s.keys[k.ID] = k
+		s.byHash[k.Hash] = k.ID
+	}
+
+	return s, nil
+}
+
+// Keys are copied in and out of the store, so callers can't change them without Put.
+func copyAPIKey(k *apiKey) *apiKey {
+	c := *k
+
+	c.Routes = append([]string(nil), k.Routes...)
+	c.Usage = make(map[string]int64, len(k.Usage))
+
+	for month, n := range k.Usage {
+		c.Usage[month] = n
+	}
+
+	return &c
+}
+
+func (s *fileKeyStore) Get(id string) (*apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, exists := s.keys[id]
+
+	if !exists {
+		return nil, errKeyNotFound
+	}
+
+	return copyAPIKey(k), nil
+}
+
+func (s *fileKeyStore) Lookup(hash string) (*apiKey, error) {
+	s.mu.Lock()
+	id, exists := s.byHash[hash]
+	s.mu.Unlock()
+
+	if !exists {
+		return nil, errKeyNotFound
+	}
+
+	return s.Get(id)
+}
+
+func (s *fileKeyStore) Put(k *apiKey, oldHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if oldHash != "" {
+		delete(s.byHash, oldHash)
+	}
+
+	s.keys[k.ID] = copyAPIKey(k)
+	s.byHash[k.Hash] = k.ID
+
+	return s.save()
+}
+
+func (s *fileKeyStore) Delete(k *apiKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.byHash, k.Hash)
+	delete(s.keys, k.ID)
+
+	return s.save()
+}
+
+func (s *fileKeyStore) List() ([]*apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*apiKey, 0, len(s.keys))
+
+	for _, k := range s.keys {
+		list = append(list, copyAPIKey(k))
+	}
+
+	return list, nil
+}
+
+// save writes the keys to the file, with s.mu held.
+func (s *fileKeyStore) save() error {
+	list := make([]*apiKey, 0, len(s.keys))
+
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+
+	b, err := json.MarshalIndent(list, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.file, b, 0600)
+}
+
+// apiKeyManager creates and checks api keys, and records their usage.
+// Usage is counted in memory and added to the stored keys by FlushUsage, so replicas sharing
+// a store may rarely lose a flush that raced with another; owapi_api_key_requests_total is exact.
+type apiKeyManager struct {
+	store apiKeyStore
+
+	// writeMu serializes reading and writing back stored keys, so a flush never restores
+	// a key revoked or the old secret of a key rotated meanwhile
+	writeMu sync.Mutex
+
+	mu    sync.Mutex
+	tiers map[string]rateLimit
+	usage map[string]int64
+}
+
+func newAPIKeyManager(store apiKeyStore, tiers map[string]rateLimit) *apiKeyManager {
+	return &apiKeyManager{store: store, tiers: tiers, usage: make(map[string]int64)}
+}
+
+// Tier returns the limit of the tier name.
+func (m *apiKeyManager) Tier(name string) (rateLimit, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limit, exists := m.tiers[name]
+
+	return limit, exists
+}
+
+// SetTiers replaces the tiers. Keys of removed tiers fall back to the anonymous limit.
+func (m *apiKeyManager) SetTiers(tiers map[string]rateLimit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tiers = tiers
+}
+
+// Lookup returns the key matching secret.
+func (m *apiKeyManager) Lookup(secret string) (*apiKey, error) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil, errKeyNotFound
+	}
+
+	return m.store.Lookup(hashAPIKey(secret))
+}
+
+// Create creates a key, returning it along with its secret, which isn't stored.
+func (m *apiKeyManager) Create(name, tier string, routes []string) (*apiKey, string, error) {
+	if name == "" {
+		return nil, "", errNoKeyName
+	}
+
+	if _, exists := m.Tier(tier); !exists {
+		return nil, "", errUnknownTier
+	}
+
+	id, err := randomHex(8)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomHex(24)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret = apiKeyPrefix + secret
+
+	k := &apiKey{ID: id, Name: name, Tier: tier, Routes: routes, Hash: hashAPIKey(secret), Created: time.Now().UTC()}
+
+	if err := m.store.Put(k, ""); err != nil {
+		return nil, "", err
+	}
+
+	return k, secret, nil
+}
+
+// Rotate replaces the secret of the key with id, returning the new one. The old secret stops working.
+func (m *apiKeyManager) Rotate(id string) (*apiKey, string, error) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	k, err := m.store.Get(id)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomHex(24)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret = apiKeyPrefix + secret
+
+	oldHash := k.Hash
+
+	now := time.Now().UTC()
+
+	k.Hash, k.Rotated = hashAPIKey(secret), &now
+
+	if err := m.store.Put(k, oldHash); err != nil {
+		return nil, "", err
+	}
+
+	return k, secret, nil
+}
+
+// Revoke deletes the key with id, along with its pending usage.
+func (m *apiKeyManager) Revoke(id string) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	k, err := m.store.Get(id)
+
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.usage, id)
+	m.mu.Unlock()
+
+	return m.store.Delete(k)
+}
+
+// Get returns the key with id, including its usage not flushed yet.
+func (m *apiKeyManager) Get(id string) (*apiKey, error) {
+	k, err := m.store.Get(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	pending := m.usage[id]
+	m.mu.Unlock()
+
+	if pending > 0 {
+		if k.Usage == nil {
+			k.Usage = make(map[string]int64)
+		}
+
+		k.Usage[time.Now().UTC().Format(usageMonthFormat)] += pending
+	}
+
+	return k, nil
+}
+
+// RecordUsage counts a request made with k.
+func (m *apiKeyManager) RecordUsage(k *apiKey) {
+	apiKeyRequests.WithLabelValues(k.ID).Inc()
+
+	m.mu.Lock()
+	m.usage[k.ID]++
+	m.mu.Unlock()
+}
+
+// FlushUsage adds the usage counted since the last flush to the stored keys, under the current month.
+// Usage not flushed because of an error is kept for the next flush.
+func (m *apiKeyManager) FlushUsage() error {
+	m.mu.Lock()
+	usage := m.usage
+	m.usage = make(map[string]int64)
+	m.mu.Unlock()
+
+	month := time.Now().UTC().Format(usageMonthFormat)
+
+	for id, n := range usage {
+		err := m.flushKeyUsage(id, month, n)
+
+		if err != nil && err != errKeyNotFound {
+			m.restoreUsage(usage)
+
+			return err
+		}
+
+		delete(usage, id)
+	}
+
+	return nil
+}
+
+// flushKeyUsage adds n requests to the usage stored for the key with id, unless it was revoked.
+func (m *apiKeyManager) flushKeyUsage(id, month string, n int64) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	k, err := m.store.Get(id)
+
+	if err != nil {
+		return err
+	}
+
+	if k.Usage == nil {
+		k.Usage = make(map[string]int64)
+	}
+
+	k.Usage[month] += n
+
+	return m.store.Put(k, "")
+}
+
+// restoreUsage adds usage that couldn't be flushed back to the pending usage.
+func (m *apiKeyManager) restoreUsage(usage map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, n := range usage {
+		m.usage[id] += n
+	}
+}
+
+// runUsageFlusher flushes usage every interval until ctx is done.
+func (m *apiKeyManager) runUsageFlusher(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := m.FlushUsage(); err != nil {
+			slog.Error("Unable to record api key usage", "error", err)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"git.meow.tf/ow-api/ow-api/cache"
+	"github.com/alicebob/miniredis/v2"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testAPIKeyManager(t *testing.T, store apiKeyStore) {
+	m := newAPIKeyManager(store, map[string]rateLimit{"sponsor": {perMinute: 600, burst: 100}})
+
+	if _, _, err := m.Create("bot", "platinum", nil); err != errUnknownTier {
+		t.Fatal("Expected an unknown tier, got", err)
+	}
+
+	k, secret, err := m.Create("bot", "sponsor", []string{"/v3/*"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := m.Lookup(secret); err != nil || found.ID != k.ID || found.Name != "bot" {
+		t.Fatal("Expected to find the key by its secret, got", found, err)
+	}
+
+	m.RecordUsage(k)
+	m.RecordUsage(k)
+
+	if err := m.FlushUsage(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.RecordUsage(k)
+
+	month := time.Now().UTC().Format(usageMonthFormat)
+
+	if found, _ := m.Get(k.ID); found.Usage[month] != 3 {
+		t.Fatal("Expected flushed and pending usage, got", found.Usage)
+	}
+
+	_, rotated, err := m.Rotate(k.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Lookup(secret); err != errKeyNotFound {
+		t.Fatal("Expected the old secret to stop working, got", err)
+	}
+
+	if found, err := m.Lookup(rotated); err != nil || found.Usage[month] != 2 {
+		t.Fatal("Expected the rotated key to keep its usage, got", found, err)
+	}
+
+	if keys, err := store.List(); err != nil || len(keys) != 1 {
+		t.Fatal("Expected a single key, got", keys, err)
+	}
+
+	if err := m.Revoke(k.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Lookup(rotated); err != errKeyNotFound {
+		t.Fatal("Expected the revoked key to stop working, got", err)
+	}
+}
+
+func Test_FileKeyStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+
+	store, err := newFileKeyStore(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testAPIKeyManager(t, store)
+
+	m := newAPIKeyManager(store, map[string]rateLimit{"free": {perMinute: 60, burst: 10}})
+
+	_, secret, err := m.Create("saved", "free", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = newFileKeyStore(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if k, err := newAPIKeyManager(store, nil).Lookup(secret); err != nil || k.Name != "saved" {
+		t.Fatal("Expected the key to be loaded from file, got", k, err)
+	}
+}
+
+// failingKeyStore fails to store keys while failing is set.
+type failingKeyStore struct {
+	apiKeyStore
+
+	failing bool
+}
+
+func (s *failingKeyStore) Put(k *apiKey, oldHash string) error {
+	if s.failing {
+		return errors.New("store unavailable")
+	}
+
+	return s.apiKeyStore.Put(k, oldHash)
+}
+
+func Test_FlushUsageError(t *testing.T) {
+	fileStore, err := newFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &failingKeyStore{apiKeyStore: fileStore}
+
+	m := newAPIKeyManager(store, map[string]rateLimit{"free": {perMinute: 60, burst: 10}})
+
+	k, _, err := m.Create("bot", "free", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.RecordUsage(k)
+	m.RecordUsage(k)
+
+	store.failing = true
+
+	if err := m.FlushUsage(); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	m.RecordUsage(k)
+
+	store.failing = false
+
+	if err := m.FlushUsage(); err != nil {
+		t.Fatal(err)
+	}
+
+	month := time.Now().UTC().Format(usageMonthFormat)
+
+	if found, _ := store.Get(k.ID); found.Usage[month] != 3 {
+		t.Fatal("Expected usage of the failed flush to be kept, got", found.Usage)
+	}
+}
+
+// pausingKeyStore pauses the first Get until release is closed, after closing paused.
+type pausingKeyStore struct {
+	apiKeyStore
+
+	gets    int32
+	paused  chan struct{}
+	release chan struct{}
+}
+
+func (s *pausingKeyStore) Get(id string) (*apiKey, error) {
+	k, err := s.apiKeyStore.Get(id)
+
+	if atomic.AddInt32(&s.gets, 1) == 1 {
+		close(s.paused)
+		<-s.release
+	}
+
+	return k, err
+}
+
+func Test_FlushUsageRevoke(t *testing.T) {
+	fileStore, err := newFileKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newAPIKeyManager(fileStore, map[string]rateLimit{"free": {perMinute: 60, burst: 10}})
+
+	k, secret, err := m.Create("bot", "free", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &pausingKeyStore{apiKeyStore: fileStore, paused: make(chan struct{}), release: make(chan struct{})}
+
+	m.store = store
+
+	m.RecordUsage(k)
+
+	flushed := make(chan error)
+
+	go func() {
+		flushed <- m.FlushUsage()
+	}()
+
+	<-store.paused
+
+	revoked := make(chan error)
+
+	go func() {
+		revoked <- m.Revoke(k.ID)
+	}()
+
+	// Give the revoke time to run ahead of the paused flush
+	time.Sleep(20 * time.Millisecond)
+
+	close(store.release)
+
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-revoked; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Lookup(secret); err != errKeyNotFound {
+		t.Fatal("Expected the revoked key to stay revoked, got", err)
+	}
+}
+
+func Test_CacheKeyStore(t *testing.T) {
+	setupTestServer(t)
+
+	addr := miniredis.RunT(t).Addr()
+
+	cacheProvider = newTestCache(t, "redis://"+addr)
+
+	store, err := newAPIKeyStore("cache")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testAPIKeyManager(t, store)
+
+	cacheProvider = newTestCache(t, "tiered://?l1=gcache://&l2=redis://"+addr)
+
+	if store, err := newAPIKeyStore("cache"); err != nil || store.(*cacheKeyStore).provider != cacheProvider.(*cache.Tiered).L2() {
+		t.Fatal("Expected keys to be stored in the shared tier only, got", err)
+	}
+
+	for _, uri := range []string{"none://", "gcache://?size=16", "file://" + t.TempDir(), "tiered://?l1=gcache://&l2=gcache://"} {
+		cacheProvider = newTestCache(t, uri)
+
+		if _, err := newAPIKeyStore("cache"); err == nil {
+			t.Errorf("Expected %s to be rejected as it may lose keys", uri)
+		}
+	}
+}
+
+func Test_AdminKeys(t *testing.T) {
+	setupTestServer(t)
+
+	oldToken, oldKeys := adminToken, apiKeys
+	adminToken = "secret"
+	apiKeys = newAPIKeyManager(&fileKeyStore{
+		file:   filepath.Join(t.TempDir(), "keys.json"),
+		keys:   make(map[string]*apiKey),
+		byHash: make(map[string]string),
+	}, map[string]rateLimit{"sponsor": {perMinute: 600, burst: 100}})
+
+	defer func() {
+		adminToken, apiKeys = oldToken, oldKeys
+	}()
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	body, _ := json.Marshal(&adminKeyRequest{Name: "discord-bot", Tier: "sponsor"})
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/keys", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var created adminKeyObject
+
+	json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated || created.Key == "" || created.Name != "discord-bot" {
+		t.Fatal("Expected the key to be created, got", res.StatusCode, created)
+	}
+
+	var rotated adminKeyObject
+
+	if status := adminRequest(t, http.MethodPost, srv.URL+"/admin/keys/"+created.ID+"/rotate", "secret", &rotated); status != http.StatusOK || rotated.Key == created.Key {
+		t.Fatal("Expected the key to be rotated, got", status, rotated)
+	}
+
+	var list adminKeysObject
+
+	adminRequest(t, http.MethodGet, srv.URL+"/admin/keys", "secret", &list)
+
+	if len(list.Keys) != 1 || list.Keys[0].Key != "" {
+		t.Fatal("Expected the key to be listed without its secret, got", list.Keys)
+	}
+
+	if status := adminRequest(t, http.MethodDelete, srv.URL+"/admin/keys/"+created.ID, "secret", nil); status != http.StatusNoContent {
+		t.Fatal("Unexpected status", status)
+	}
+
+	if status := adminRequest(t, http.MethodGet, srv.URL+"/admin/keys/"+created.ID, "secret", nil); status != http.StatusNotFound {
+		t.Fatal("Expected the revoked key to be gone, got", status)
+	}
+}
@@ -1,34 +1,160 @@
 package cache
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/url"
+	"sort"
+	"sync"
 	"time"
 )
 
+const (
+	// NoExpiration is returned by TTL for keys stored without an expiry.
+	NoExpiration time.Duration = -1
+)
+
+var (
+	ErrNotFound     = errors.New("cache: key not found")
+	ErrNotSupported = errors.New("cache: operation not supported by provider")
+)
+
+// Provider is a key/value store for cached responses.
+// Missing keys are reported with ErrNotFound, and a zero duration stores a key without expiry.
 type Provider interface {
 	Get(key string) ([]byte, error)
 	Set(key string, b []byte, d time.Duration) error
+	Delete(key string) error
+
+	// TTL returns the time left before key expires, or NoExpiration.
+	TTL(key string) (time.Duration, error)
+
+	// GetMulti returns the values of all keys found, omitting missing ones.
+	GetMulti(keys []string) (map[string][]byte, error)
+	SetMulti(items map[string][]byte, d time.Duration) error
+
+	// Keys lists the keys starting with prefix.
+	Keys(prefix string) ([]string, error)
+
+	// Purge deletes every key starting with prefix and returns how many were removed.
+	Purge(prefix string) (int, error)
+}
+
+// Pinger is implemented by providers backed by a server, to check it can be reached.
+type Pinger interface {
+	Ping() error
 }
 
-func ForURI(uri string) Provider {
+// Durable reports whether p keeps keys stored without expiry until they are deleted, and shares them
+// between replicas, as redis does. Size limited providers (gcache, file) may evict keys, memcached and none
+// don't keep them, and tiered providers keep serving deleted keys from L1 for a while.
+func Durable(p Provider) bool {
+	switch p := p.(type) {
+	case *RedisCache:
+		return true
+	case *Compressed:
+		return Durable(p.Provider)
+	}
+
+	return false
+}
+
+// Close releases the connections and background work of p, when it implements io.Closer.
+func Close(p Provider) error {
+	if closer, ok := p.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Factory creates a provider from its uri.
+type Factory func(u *url.URL) (Provider, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a provider available to ForURI under scheme.
+// It panics if the scheme is already registered.
+func Register(scheme string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("cache: Register factory is nil")
+	}
+
+	if _, exists := factories[scheme]; exists {
+		panic("cache: Register called twice for scheme " + scheme)
+	}
+
+	factories[scheme] = factory
+}
+
+// Schemes returns the sorted list of registered schemes.
+func Schemes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	schemes := make([]string, 0, len(factories))
+
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// ForURI creates the provider registered for the uri's scheme, checking that its server can be reached.
+// A bare scheme such as "none" or "gcache" is accepted as well.
+// Any uri may add compress=gzip|zstd|snappy (and compress_min=bytes) to compress stored values.
+func ForURI(uri string) (Provider, error) {
 	u, err := url.Parse(uri)
 
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("invalid cache uri: %w", err)
 	}
 
 	if u.Scheme == "" && u.Path != "" {
 		u.Scheme = u.Path
 	}
 
-	switch u.Scheme {
-	case "memcached":
-		return NewMemcached(u)
-	case "redis":
-		return NewRedisCache(u)
-	case "gcache":
-		return NewGcache(u)
+	factoriesMu.RLock()
+	factory, exists := factories[u.Scheme]
+	factoriesMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown cache scheme %q, expected one of %v", u.Scheme, Schemes())
+	}
+
+	p, err := factory(u)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure %s cache: %w", u.Scheme, err)
+	}
+
+	if pinger, ok := p.(Pinger); ok {
+		if err := pinger.Ping(); err != nil {
+			Close(p)
+
+			return nil, fmt.Errorf("unable to reach %s cache: %w", u.Scheme, err)
+		}
+	}
+
+	q := u.Query()
+
+	c, err := withCompression(p, q.Get("compress"), q.Get("compress_min"))
+
+	if err != nil {
+		Close(p)
+
+		return nil, err
 	}
 
-	return &NullCache{}
+	return c, nil
 }
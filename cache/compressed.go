@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	codecGzip byte = iota + 1
+	codecZstd
+	codecSnappy
+
+	defaultCompressMin = 512
+)
+
+var (
+	// compressedMagic prefixes compressed values, followed by the codec id
+	compressedMagic = []byte("OWZ")
+
+	codecNames = map[string]byte{
+		"gzip":   codecGzip,
+		"zstd":   codecZstd,
+		"snappy": codecSnappy,
+	}
+
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+
+	compressionStats = expvar.NewMap("cacheCompression")
+	uncompressedSize = new(expvar.Int)
+	compressedSize   = new(expvar.Int)
+)
+
+func init() {
+	compressionStats.Set("uncompressedBytes", uncompressedSize)
+	compressionStats.Set("compressedBytes", compressedSize)
+	compressionStats.Set("ratio", expvar.Func(func() interface{} {
+		if uncompressedSize.Value() == 0 {
+			return 1.0
+		}
+
+		return float64(compressedSize.Value()) / float64(uncompressedSize.Value())
+	}))
+}
+
+// Compressed compresses values stored in another provider.
+// Values without the compression header, such as ones stored before compression was enabled, are read as is.
+type Compressed struct {
+	Provider
+
+	codec byte
+	min   int
+}
+
+// NewCompressed wraps p to compress values of at least min bytes using codec (gzip, zstd or snappy).
+func NewCompressed(p Provider, codec string, min int) (*Compressed, error) {
+	id, exists := codecNames[codec]
+
+	if !exists {
+		return nil, fmt.Errorf("unknown compression %q", codec)
+	}
+
+	return &Compressed{Provider: p, codec: id, min: min}, nil
+}
+
+// withCompression wraps p when its uri has a compress parameter, with compress_min as the size threshold.
+func withCompression(p Provider, codec, min string) (Provider, error) {
+	if codec == "" {
+		return p, nil
+	}
+
+	minSize := defaultCompressMin
+
+	if min != "" {
+		var err error
+
+		if minSize, err = strconv.Atoi(min); err != nil {
+			return nil, fmt.Errorf("invalid compress_min %q", min)
+		}
+	}
+
+	return NewCompressed(p, codec, minSize)
+}
+
+func (c *Compressed) Get(key string) ([]byte, error) {
+	b, err := c.Provider.Get(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(b)
+}
+
+func (c *Compressed) Set(key string, b []byte, d time.Duration) error {
+	b, err := c.compress(b)
+
+	if err != nil {
+		return err
+	}
+
+	return c.Provider.Set(key, b, d)
+}
+
+func (c *Compressed) GetMulti(keys []string) (map[string][]byte, error) {
+	m, err := c.Provider.GetMulti(keys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for key, b := range m {
+		if m[key], err = decompress(b); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (c *Compressed) SetMulti(items map[string][]byte, d time.Duration) error {
+	compressed := make(map[string][]byte, len(items))
+
+	for key, b := range items {
+		var err error
+
+		if compressed[key], err = c.compress(b); err != nil {
+			return err
+		}
+	}
+
+	return c.Provider.SetMulti(compressed, d)
+}
+
+// Close closes the wrapped provider.
+func (c *Compressed) Close() error {
+	return Close(c.Provider)
+}
+
+func (c *Compressed) compress(b []byte) ([]byte, error) {
+	if len(b) < c.min {
+		return b, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(b)/4))
+
+	buf.Write(compressedMagic)
+	buf.WriteByte(c.codec)
+
+	switch c.codec {
+	case codecGzip:
+		w := gzip.NewWriter(buf)
+
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case codecZstd:
+		buf.Write(zstdEncoder.EncodeAll(b, nil))
+	case codecSnappy:
+		buf.Write(snappy.Encode(nil, b))
+	}
+
+	uncompressedSize.Add(int64(len(b)))
+	compressedSize.Add(int64(buf.Len()))
+
+	return buf.Bytes(), nil
+}
+
+func decompress(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, compressedMagic) || len(b) <= len(compressedMagic) {
+		return b, nil
+	}
+
+	codec, data := b[len(compressedMagic)], b[len(compressedMagic)+1:]
+
+	switch codec {
+	case codecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer r.Close()
+
+		return io.ReadAll(r)
+	case codecZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case codecSnappy:
+		return snappy.Decode(nil, data)
+	}
+
+	return nil, fmt.Errorf("unknown compression codec %d", codec)
+}
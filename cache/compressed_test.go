@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_Compressed(t *testing.T) {
+	for codec := range codecNames {
+		t.Run(codec, func(t *testing.T) {
+			c, err := NewCompressed(NewGcache(&url.URL{}), codec, 0)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testProvider(t, c, false)
+		})
+	}
+}
+
+func Test_CompressedRoundTrip(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"eliminations":1502,"deaths":240},`), 200)
+
+	for codec := range codecNames {
+		inner := NewGcache(&url.URL{})
+
+		p, err := ForURI("gcache://?compress=" + codec)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := p.(*Compressed)
+		c.Provider = inner
+
+		if err := c.Set("key", value, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, _ := inner.Get("key")
+
+		if !bytes.HasPrefix(stored, compressedMagic) || len(stored) >= len(value) {
+			t.Fatalf("Expected %s to store a smaller compressed value, got %d bytes", codec, len(stored))
+		}
+
+		b, err := c.Get("key")
+
+		if err != nil || !bytes.Equal(b, value) {
+			t.Fatal("Expected the original value from", codec, err)
+		}
+	}
+}
+
+func Test_CompressedReadsUncompressed(t *testing.T) {
+	inner := NewGcache(&url.URL{})
+
+	// Stored before compression was enabled
+	inner.Set("legacy", []byte(`{"name":"cats"}`), time.Minute)
+
+	c, _ := NewCompressed(inner, "zstd", 0)
+
+	if b, err := c.Get("legacy"); err != nil || string(b) != `{"name":"cats"}` {
+		t.Fatal("Expected the uncompressed value, got", string(b), err)
+	}
+
+	// Small values stay uncompressed
+	c.min = 512
+
+	c.Set("small", []byte("value"), time.Minute)
+
+	if b, _ := inner.Get("small"); string(b) != "value" {
+		t.Fatal("Expected the small value to be stored as is, got", string(b))
+	}
+}
+
+func Test_CompressedInvalid(t *testing.T) {
+	for _, uri := range []string{"gcache://?compress=lz4", "gcache://?compress=zstd&compress_min=big"} {
+		if _, err := ForURI(uri); err == nil {
+			t.Fatal("Expected an error for", uri)
+		}
+	}
+}
@@ -0,0 +1,569 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDiskMaxSize         = 256 << 20
+	defaultDiskCompactInterval = 10 * time.Minute
+)
+
+var (
+	// diskMagic starts every cache file, followed by the expiry, the key length, the key and the value
+	diskMagic = []byte("OWD1")
+
+	errInvalidDiskFile = errors.New("invalid cache file")
+	errNoDiskPath      = errors.New("file cache requires a directory path")
+
+	sizeUnits = map[string]int64{
+		"":   1,
+		"B":  1,
+		"KB": 1 << 10,
+		"MB": 1 << 20,
+		"GB": 1 << 30,
+	}
+)
+
+func init() {
+	Register("file", func(u *url.URL) (Provider, error) {
+		return NewDiskCache(u)
+	})
+}
+
+// DiskCache stores each key in its own file, so cached responses survive restarts.
+// An in-memory index of the files is rebuilt on start. The least recently used files are removed as soon as
+// the directory grows past its size limit, and expired ones by a background compaction.
+type DiskCache struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	index map[string]*diskItem
+	size  int64
+
+	// lru orders the items from the most to the least recently used
+	lru *list.List
+
+	stop chan struct{}
+	once sync.Once
+}
+
+type diskItem struct {
+	key     string
+	file    string
+	size    int64
+	expires time.Time
+
+	elem *list.Element
+}
+
+func (i *diskItem) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+// NewDiskCache opens the cache directory from a uri such as file:///var/lib/owapi/cache?max_size=256MB&compact_interval=10m,
+// creating it when missing.
+func NewDiskCache(u *url.URL) (*DiskCache, error) {
+	dir := u.Host + u.Path
+
+	if dir == "" {
+		return nil, errNoDiskPath
+	}
+
+	q := u.Query()
+
+	maxSize := int64(defaultDiskMaxSize)
+
+	if s := q.Get("max_size"); s != "" {
+		var err error
+
+		if maxSize, err = parseSize(s); err != nil {
+			return nil, err
+		}
+	}
+
+	interval := defaultDiskCompactInterval
+
+	if s := q.Get("compact_interval"); s != "" {
+		var err error
+
+		if interval, err = time.ParseDuration(s); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid compact_interval %q", s)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	c := &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		index:   make(map[string]*diskItem),
+		lru:     list.New(),
+		stop:    make(chan struct{}),
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	go c.compactLoop(interval)
+
+	return c, nil
+}
+
+// parseSize parses sizes such as 512, 64KB, 256MB or 1GB.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+
+	if i == -1 {
+		i = len(s)
+	}
+
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+
+	unit, exists := sizeUnits[s[i:]]
+
+	if err != nil || !exists {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return n * unit, nil
+}
+
+// load rebuilds the index from the files in the cache directory, removing expired and unreadable ones.
+// Only the shard directories written by the cache are read, and anything else in the directory is left alone.
+func (c *DiskCache) load() error {
+	now := time.Now()
+
+	accessed := make(map[*diskItem]time.Time)
+
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == c.dir {
+			return nil
+		}
+
+		if info.IsDir() {
+			if filepath.Dir(path) != c.dir || !isHexName(info.Name(), 2) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if filepath.Dir(filepath.Dir(path)) != c.dir {
+			return nil
+		}
+
+		if strings.HasSuffix(path, ".tmp") {
+			return os.Remove(path)
+		}
+
+		if !isHexName(info.Name(), sha1.Size*2) {
+			return nil
+		}
+
+		key, expires, err := readDiskHeader(path)
+
+		if err != nil || (!expires.IsZero() && !now.Before(expires)) {
+			return os.Remove(path)
+		}
+
+		item := &diskItem{key: key, file: path, size: info.Size(), expires: expires}
+
+		c.index[key] = item
+		c.size += info.Size()
+
+		accessed[item] = info.ModTime()
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Files were last used when they were written
+	items := make([]*diskItem, 0, len(c.index))
+
+	for _, item := range c.index {
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return accessed[items[i]].After(accessed[items[j]])
+	})
+
+	for _, item := range items {
+		item.elem = c.lru.PushBack(item)
+	}
+
+	return nil
+}
+
+// isHexName reports whether name is n lowercase hex digits, as used for the shard directories and files.
+func isHexName(name string, n int) bool {
+	if len(name) != n {
+		return false
+	}
+
+	for _, r := range name {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *DiskCache) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+
+	name := hex.EncodeToString(sum[:])
+
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+func readDiskHeader(path string) (string, time.Time, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	defer f.Close()
+
+	key, expires, _, err := decodeDiskHeader(f)
+
+	return key, expires, err
+}
+
+func decodeDiskHeader(r io.Reader) (string, time.Time, int, error) {
+	header := make([]byte, len(diskMagic)+10)
+
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, diskMagic) {
+		return "", time.Time{}, 0, errInvalidDiskFile
+	}
+
+	header = header[len(diskMagic):]
+
+	var expires time.Time
+
+	if n := int64(binary.BigEndian.Uint64(header)); n > 0 {
+		expires = time.Unix(0, n)
+	}
+
+	key := make([]byte, binary.BigEndian.Uint16(header[8:]))
+
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", time.Time{}, 0, errInvalidDiskFile
+	}
+
+	return string(key), expires, len(diskMagic) + 10 + len(key), nil
+}
+
+func (c *DiskCache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+
+	item, exists := c.index[key]
+
+	now := time.Now()
+
+	if !exists || item.expired(now) {
+		c.mu.Unlock()
+		return nil, ErrNotFound
+	}
+
+	c.lru.MoveToFront(item.elem)
+
+	c.mu.Unlock()
+
+	b, err := os.ReadFile(item.file)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	_, _, n, err := decodeDiskHeader(bytes.NewReader(b))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b[n:], nil
+}
+
+func (c *DiskCache) Set(key string, b []byte, d time.Duration) error {
+	if len(key) > 0xffff {
+		return fmt.Errorf("key too long")
+	}
+
+	var expires time.Time
+	var expiresNano int64
+
+	if d > 0 {
+		expires = time.Now().Add(d)
+		expiresNano = expires.UnixNano()
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(diskMagic)+10+len(key)+len(b)))
+
+	buf.Write(diskMagic)
+
+	binary.Write(buf, binary.BigEndian, expiresNano)
+	binary.Write(buf, binary.BigEndian, uint16(len(key)))
+
+	buf.WriteString(key)
+	buf.Write(b)
+
+	path := c.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so readers never see a partial file
+	f, err := os.CreateTemp(filepath.Dir(path), "*.tmp")
+
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	_, err = f.Write(buf.Bytes())
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if old, exists := c.index[key]; exists {
+		c.size -= old.size
+
+		c.lru.Remove(old.elem)
+	}
+
+	item := &diskItem{key: key, file: path, size: int64(buf.Len()), expires: expires}
+
+	item.elem = c.lru.PushFront(item)
+
+	c.index[key] = item
+	c.size += item.size
+
+	c.evictOverSize()
+
+	return nil
+}
+
+func (c *DiskCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.remove(key)
+}
+
+// remove deletes the file of key, with c.mu held.
+func (c *DiskCache) remove(key string) error {
+	item, exists := c.index[key]
+
+	if !exists {
+		return nil
+	}
+
+	delete(c.index, key)
+
+	c.lru.Remove(item.elem)
+
+	c.size -= item.size
+
+	if err := os.Remove(item.file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *DiskCache) TTL(key string) (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, exists := c.index[key]
+
+	now := time.Now()
+
+	if !exists || item.expired(now) {
+		return 0, ErrNotFound
+	}
+
+	if item.expires.IsZero() {
+		return NoExpiration, nil
+	}
+
+	return item.expires.Sub(now), nil
+}
+
+func (c *DiskCache) GetMulti(keys []string) (map[string][]byte, error) {
+	m := make(map[string][]byte)
+
+	for _, key := range keys {
+		b, err := c.Get(key)
+
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		m[key] = b
+	}
+
+	return m, nil
+}
+
+func (c *DiskCache) SetMulti(items map[string][]byte, d time.Duration) error {
+	for key, b := range items {
+		if err := c.Set(key, b, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *DiskCache) Keys(prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	keys := make([]string, 0)
+
+	for key, item := range c.index {
+		if strings.HasPrefix(key, prefix) && !item.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (c *DiskCache) Purge(prefix string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+
+	for key := range c.index {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if err := c.remove(key); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// Compact removes expired files, then the least recently used ones until the cache fits its size limit.
+func (c *DiskCache) Compact() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evict()
+}
+
+// evict implements Compact, with c.mu held.
+func (c *DiskCache) evict() {
+	now := time.Now()
+
+	for key, item := range c.index {
+		if item.expired(now) {
+			if err := c.remove(key); err != nil {
+				slog.Warn("Unable to remove expired cache file", "error", err)
+			}
+		}
+	}
+
+	c.evictOverSize()
+}
+
+// evictOverSize removes the least recently used files until the cache fits its size limit, with c.mu held.
+func (c *DiskCache) evictOverSize() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		item := c.lru.Back().Value.(*diskItem)
+
+		if err := c.remove(item.key); err != nil {
+			slog.Warn("Unable to evict cache file", "error", err)
+		}
+	}
+}
+
+func (c *DiskCache) compactLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			c.Compact()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background compaction.
+func (c *DiskCache) Close() error {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDiskCache(t *testing.T, dir, query string) *DiskCache {
+	c, err := NewDiskCache(mustParseURL(t, "file://"+dir+query))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		c.Close()
+	})
+
+	return c
+}
+
+func Test_DiskCache(t *testing.T) {
+	testProvider(t, newTestDiskCache(t, t.TempDir(), ""), false)
+}
+
+func Test_DiskCacheReload(t *testing.T) {
+	dir := t.TempDir()
+
+	c := newTestDiskCache(t, dir, "")
+
+	c.Set("kept", []byte("value"), time.Hour)
+	c.Set("expired", []byte("value"), time.Millisecond)
+
+	time.Sleep(5 * time.Millisecond)
+
+	c = newTestDiskCache(t, dir, "")
+
+	if b, err := c.Get("kept"); err != nil || string(b) != "value" {
+		t.Fatal("Expected the value to survive a restart, got", string(b), err)
+	}
+
+	if d, err := c.TTL("kept"); err != nil || d <= 0 || d > time.Hour {
+		t.Fatal("Expected the expiry to survive a restart, got", d, err)
+	}
+
+	if _, exists := c.index["expired"]; exists {
+		t.Fatal("Expected the expired file to be removed on load")
+	}
+}
+
+func Test_DiskCacheForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	foreign := []string{
+		filepath.Join(dir, "notes.txt"),
+		filepath.Join(dir, "src", "main.go"),
+		filepath.Join(dir, "ab", "README"),
+	}
+
+	for _, file := range foreign {
+		if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(file, []byte("not a cache file"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broken := filepath.Join(dir, "ab", "ab"+strings.Repeat("0", 38))
+
+	if err := os.WriteFile(broken, []byte("not a cache file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newTestDiskCache(t, dir, "")
+
+	for _, file := range foreign {
+		if _, err := os.Stat(file); err != nil {
+			t.Error("Expected a file not written by the cache to be kept, got", err)
+		}
+	}
+
+	if _, err := os.Stat(broken); !os.IsNotExist(err) {
+		t.Error("Expected an unreadable cache file to be removed, got", err)
+	}
+}
+
+func Test_DiskCacheSizeLimit(t *testing.T) {
+	c := newTestDiskCache(t, t.TempDir(), "?max_size=1KB")
+
+	value := make([]byte, 300)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Set(key, value, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// Reading a makes b the least recently used
+	c.Get("a")
+
+	c.Set("d", value, time.Hour)
+
+	if _, err := c.Get("b"); err != ErrNotFound {
+		t.Fatal("Expected the least recently used key to be evicted, got", err)
+	}
+
+	if _, err := c.Get("a"); err != nil {
+		t.Fatal("Expected the recently used key to be kept, got", err)
+	}
+
+	if c.size > c.maxSize {
+		t.Fatal("Expected the cache to fit its size limit, got", c.size)
+	}
+}
+
+func Test_ParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{"512": 512, "64kb": 64 << 10, "256MB": 256 << 20, "1GB": 1 << 30} {
+		if n, err := parseSize(s); err != nil || n != expected {
+			t.Fatal("Unexpected size for", s, n, err)
+		}
+	}
+
+	if _, err := parseSize("lots"); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	entryMagic = []byte("OWE1")
+
+	ErrInvalidEntry = errors.New("invalid cache entry")
+)
+
+// Entry is a cached payload along with the times it stops being fresh and stops being usable at all.
+// Kind marks negative entries, which cache an outcome such as a missing player instead of (or along with) a payload.
+// ETag identifies the payload, and Modified is when it was fetched.
+type Entry struct {
+	Data       []byte    `json:"-"`
+	Kind       string    `json:"kind,omitempty"`
+	FreshUntil time.Time `json:"freshUntil"`
+	StaleUntil time.Time `json:"staleUntil"`
+	ETag       string    `json:"etag,omitempty"`
+	Modified   time.Time `json:"modified"`
+}
+
+// ETag returns a strong entity tag for payload.
+func ETag(payload []byte) string {
+	sum := sha256.Sum256(payload)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Fresh reports whether the entry can be served without revalidation.
+// Entries without freshness information are always fresh.
+func (e *Entry) Fresh(now time.Time) bool {
+	return e.FreshUntil.IsZero() || now.Before(e.FreshUntil)
+}
+
+// EncodeEntry serializes an entry as the magic header, the length prefixed metadata and the payload.
+func EncodeEntry(e *Entry) ([]byte, error) {
+	meta, err := json.Marshal(e)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(entryMagic)+4+len(meta)+len(e.Data)))
+
+	buf.Write(entryMagic)
+
+	binary.Write(buf, binary.BigEndian, uint32(len(meta)))
+
+	buf.Write(meta)
+	buf.Write(e.Data)
+
+	return buf.Bytes(), nil
+}
+
+// DecodeEntry reads an entry created by EncodeEntry.
+// Payloads stored before entries existed are returned as entries without freshness information.
+func DecodeEntry(b []byte) (*Entry, error) {
+	if !bytes.HasPrefix(b, entryMagic) {
+		return &Entry{Data: b}, nil
+	}
+
+	b = b[len(entryMagic):]
+
+	if len(b) < 4 {
+		return nil, ErrInvalidEntry
+	}
+
+	metaLen := binary.BigEndian.Uint32(b)
+
+	b = b[4:]
+
+	if uint64(len(b)) < uint64(metaLen) {
+		return nil, ErrInvalidEntry
+	}
+
+	e := &Entry{}
+
+	if err := json.Unmarshal(b[:metaLen], e); err != nil {
+		return nil, ErrInvalidEntry
+	}
+
+	e.Data = b[metaLen:]
+
+	return e, nil
+}
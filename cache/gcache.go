@@ -4,13 +4,26 @@ import (
 	"github.com/bluele/gcache"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
+func init() {
+	Register("gcache", func(u *url.URL) (Provider, error) {
+		return NewGcache(u), nil
+	})
+}
+
 type Gcache struct {
 	cache gcache.Cache
 }
 
+// gcacheItem keeps the expiry next to the value, as gcache doesn't expose it.
+type gcacheItem struct {
+	b       []byte
+	expires time.Time
+}
+
 func NewGcache(u *url.URL) *Gcache {
 	size := 128
 
@@ -36,12 +49,94 @@ func (c *Gcache) Get(key string) ([]byte, error) {
 	res, err := c.cache.Get(key)
 
 	if err != nil {
+		if err == gcache.KeyNotFoundError {
+			err = ErrNotFound
+		}
+
 		return nil, err
 	}
 
-	return res.([]byte), err
+	return res.(*gcacheItem).b, err
 }
 
 func (c *Gcache) Set(key string, b []byte, d time.Duration) error {
-	return c.cache.SetWithExpire(key, b, d)
+	if d <= 0 {
+		return c.cache.Set(key, &gcacheItem{b: b})
+	}
+
+	return c.cache.SetWithExpire(key, &gcacheItem{b: b, expires: time.Now().Add(d)}, d)
+}
+
+func (c *Gcache) Delete(key string) error {
+	c.cache.Remove(key)
+
+	return nil
+}
+
+func (c *Gcache) TTL(key string) (time.Duration, error) {
+	res, err := c.cache.Get(key)
+
+	if err != nil {
+		if err == gcache.KeyNotFoundError {
+			err = ErrNotFound
+		}
+
+		return 0, err
+	}
+
+	item := res.(*gcacheItem)
+
+	if item.expires.IsZero() {
+		return NoExpiration, nil
+	}
+
+	return time.Until(item.expires), nil
+}
+
+func (c *Gcache) GetMulti(keys []string) (map[string][]byte, error) {
+	m := make(map[string][]byte)
+
+	for _, key := range keys {
+		if res, err := c.cache.GetIFPresent(key); err == nil {
+			m[key] = res.(*gcacheItem).b
+		}
+	}
+
+	return m, nil
+}
+
+func (c *Gcache) SetMulti(items map[string][]byte, d time.Duration) error {
+	for key, b := range items {
+		if err := c.Set(key, b, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Gcache) Keys(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+
+	for _, key := range c.cache.Keys(true) {
+		if s, ok := key.(string); ok && strings.HasPrefix(s, prefix) {
+			keys = append(keys, s)
+		}
+	}
+
+	return keys, nil
+}
+
+func (c *Gcache) Purge(prefix string) (int, error) {
+	keys, _ := c.Keys(prefix)
+
+	count := 0
+
+	for _, key := range keys {
+		if c.cache.Remove(key) {
+			count++
+		}
+	}
+
+	return count, nil
 }
@@ -1,12 +1,25 @@
 package cache
 
 import (
+	"bytes"
+	"encoding/binary"
 	"github.com/bradfitz/gomemcache/memcache"
 	"net/url"
 	"strings"
 	"time"
 )
 
+var (
+	// memcachedMagic prefixes values stored with their expiry, as memcached can't report it
+	memcachedMagic = []byte("OWM1")
+)
+
+func init() {
+	Register("memcached", func(u *url.URL) (Provider, error) {
+		return NewMemcached(u), nil
+	})
+}
+
 type Memcached struct {
 	client *memcache.Client
 }
@@ -17,16 +30,134 @@ func NewMemcached(u *url.URL) *Memcached {
 	return &Memcached{client: mc}
 }
 
+// Ping checks every server responds to the version command.
+func (m *Memcached) Ping() error {
+	return m.client.Ping()
+}
+
+// Close closes the idle connections to the servers.
+func (m *Memcached) Close() error {
+	return m.client.Close()
+}
+
 func (m *Memcached) Get(key string) ([]byte, error) {
 	item, err := m.client.Get(key)
 
 	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			err = ErrNotFound
+		}
+
 		return nil, err
 	}
 
-	return item.Value, nil
+	b, _ := decodeMemcachedValue(item.Value)
+
+	return b, nil
 }
 
 func (m *Memcached) Set(key string, b []byte, d time.Duration) error {
-	return m.client.Set(&memcache.Item{Key: key, Value: b, Expiration: int32(d.Seconds())})
+	return m.client.Set(newMemcachedItem(key, b, d))
+}
+
+func (m *Memcached) Delete(key string) error {
+	err := m.client.Delete(key)
+
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+
+	return err
+}
+
+func (m *Memcached) TTL(key string) (time.Duration, error) {
+	item, err := m.client.Get(key)
+
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			err = ErrNotFound
+		}
+
+		return 0, err
+	}
+
+	_, expires := decodeMemcachedValue(item.Value)
+
+	if expires.IsZero() {
+		return NoExpiration, nil
+	}
+
+	return time.Until(expires), nil
+}
+
+func (m *Memcached) GetMulti(keys []string) (map[string][]byte, error) {
+	items, err := m.client.GetMulti(keys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]byte, len(items))
+
+	for key, item := range items {
+		res[key], _ = decodeMemcachedValue(item.Value)
+	}
+
+	return res, nil
+}
+
+func (m *Memcached) SetMulti(items map[string][]byte, d time.Duration) error {
+	for key, b := range items {
+		if err := m.client.Set(newMemcachedItem(key, b, d)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Keys is not supported, as memcached has no way to list keys.
+func (m *Memcached) Keys(prefix string) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// Purge is not supported, as memcached has no way to list keys.
+func (m *Memcached) Purge(prefix string) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func newMemcachedItem(key string, b []byte, d time.Duration) *memcache.Item {
+	var expires int64
+
+	if d > 0 {
+		expires = time.Now().Add(d).UnixNano()
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(memcachedMagic)+8+len(b)))
+
+	buf.Write(memcachedMagic)
+
+	binary.Write(buf, binary.BigEndian, expires)
+
+	buf.Write(b)
+
+	return &memcache.Item{Key: key, Value: buf.Bytes(), Expiration: int32(d.Seconds())}
+}
+
+// decodeMemcachedValue splits a stored value into the payload and its expiry.
+// Values stored without the header are returned as is, without expiry.
+func decodeMemcachedValue(b []byte) ([]byte, time.Time) {
+	if !bytes.HasPrefix(b, memcachedMagic) || len(b) < len(memcachedMagic)+8 {
+		return b, time.Time{}
+	}
+
+	b = b[len(memcachedMagic):]
+
+	var expires time.Time
+
+	if n := int64(binary.BigEndian.Uint64(b)); n > 0 {
+		expires = time.Unix(0, n)
+	}
+
+	return b[8:], expires
 }
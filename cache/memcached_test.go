@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemcached implements enough of the memcached text protocol for the gomemcache client.
+type fakeMemcached struct {
+	mu    sync.Mutex
+	items map[string]fakeMemcachedItem
+}
+
+type fakeMemcachedItem struct {
+	flags   string
+	value   []byte
+	expires time.Time
+}
+
+func runFakeMemcached(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	f := &fakeMemcached{items: make(map[string]fakeMemcachedItem)}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go f.serve(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func (f *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	for {
+		line, err := rw.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		f.mu.Lock()
+
+		switch fields[0] {
+		case "get", "gets":
+			for _, key := range fields[1:] {
+				if item, ok := f.lookup(key); ok {
+					fmt.Fprintf(rw, "VALUE %s %s %d 0\r\n", key, item.flags, len(item.value))
+					rw.Write(item.value)
+					rw.WriteString("\r\n")
+				}
+			}
+
+			rw.WriteString("END\r\n")
+		case "set":
+			size, _ := strconv.Atoi(fields[4])
+
+			value := make([]byte, size+2)
+
+			if _, err := io.ReadFull(rw, value); err != nil {
+				f.mu.Unlock()
+				return
+			}
+
+			item := fakeMemcachedItem{flags: fields[2], value: value[:size]}
+
+			if exp, _ := strconv.Atoi(fields[3]); exp > 0 {
+				item.expires = time.Now().Add(time.Duration(exp) * time.Second)
+			}
+
+			f.items[fields[1]] = item
+
+			rw.WriteString("STORED\r\n")
+		case "delete":
+			if _, ok := f.lookup(fields[1]); ok {
+				delete(f.items, fields[1])
+				rw.WriteString("DELETED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+		case "version":
+			rw.WriteString("VERSION 1.6.0\r\n")
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+
+		f.mu.Unlock()
+
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeMemcached) lookup(key string) (fakeMemcachedItem, bool) {
+	item, ok := f.items[key]
+
+	if ok && !item.expires.IsZero() && time.Now().After(item.expires) {
+		delete(f.items, key)
+		return item, false
+	}
+
+	return item, ok
+}
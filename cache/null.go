@@ -1,14 +1,50 @@
 package cache
 
-import "time"
+import (
+	"net/url"
+	"time"
+)
+
+func init() {
+	factory := func(u *url.URL) (Provider, error) {
+		return &NullCache{}, nil
+	}
+
+	Register("none", factory)
+	Register("null", factory)
+}
 
 type NullCache struct {
 }
 
 func (n *NullCache) Get(key string) ([]byte, error) {
-	return nil, nil
+	return nil, ErrNotFound
 }
 
 func (n *NullCache) Set(key string, b []byte, d time.Duration) error {
 	return nil
 }
+
+func (n *NullCache) Delete(key string) error {
+	return nil
+}
+
+func (n *NullCache) TTL(key string) (time.Duration, error) {
+	return 0, ErrNotFound
+}
+
+func (n *NullCache) GetMulti(keys []string) (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+func (n *NullCache) SetMulti(items map[string][]byte, d time.Duration) error {
+	return nil
+}
+
+func (n *NullCache) Keys(prefix string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (n *NullCache) Purge(prefix string) (int, error) {
+	return 0, nil
+}
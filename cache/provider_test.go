@@ -0,0 +1,352 @@
+package cache
+
+import (
+	"bytes"
+	"github.com/alicebob/miniredis/v2"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testProvider runs the conformance suite every Provider must pass.
+// Providers which discard everything (NullCache) are expected to miss on every read.
+func testProvider(t *testing.T, p Provider, discards bool) {
+	t.Run("GetMissing", func(t *testing.T) {
+		if _, err := p.Get("missing"); err != ErrNotFound {
+			t.Fatal("Expected ErrNotFound, got", err)
+		}
+	})
+
+	t.Run("SetGet", func(t *testing.T) {
+		if err := p.Set("set-get", []byte("value"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := p.Get("set-get")
+
+		if discards {
+			if err != ErrNotFound {
+				t.Fatal("Expected ErrNotFound, got", err)
+			}
+
+			return
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, []byte("value")) {
+			t.Fatalf("Expected value, got %q", b)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := p.Set("delete", []byte("value"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Delete("delete"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := p.Get("delete"); err != ErrNotFound {
+			t.Fatal("Expected ErrNotFound after delete, got", err)
+		}
+
+		if err := p.Delete("delete"); err != nil {
+			t.Fatal("Expected deleting a missing key to succeed, got", err)
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		if _, err := p.TTL("missing"); err != ErrNotFound {
+			t.Fatal("Expected ErrNotFound, got", err)
+		}
+
+		if err := p.Set("ttl", []byte("value"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Set("ttl-none", []byte("value"), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := p.TTL("ttl")
+
+		if discards {
+			if err != ErrNotFound {
+				t.Fatal("Expected ErrNotFound, got", err)
+			}
+
+			return
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d <= 0 || d > time.Minute {
+			t.Fatal("Expected a ttl within a minute, got", d)
+		}
+
+		if d, err = p.TTL("ttl-none"); err != nil || d != NoExpiration {
+			t.Fatal("Expected NoExpiration, got", d, err)
+		}
+	})
+
+	t.Run("Multi", func(t *testing.T) {
+		items := map[string][]byte{
+			"multi-a": []byte("a"),
+			"multi-b": []byte("b"),
+		}
+
+		if err := p.SetMulti(items, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := p.GetMulti([]string{"multi-a", "multi-b", "multi-missing"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if discards {
+			if len(m) != 0 {
+				t.Fatal("Expected no values, got", m)
+			}
+
+			return
+		}
+
+		if len(m) != 2 || string(m["multi-a"]) != "a" || string(m["multi-b"]) != "b" {
+			t.Fatal("Unexpected values", m)
+		}
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		items := map[string][]byte{
+			"keys-a":   []byte("a"),
+			"keys-b":   []byte("b"),
+			"keyed-no": []byte("c"),
+		}
+
+		if err := p.SetMulti(items, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := p.Keys("keys-")
+
+		if err == ErrNotSupported {
+			t.Skip("Keys not supported")
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if discards {
+			if len(keys) != 0 {
+				t.Fatal("Expected no keys, got", keys)
+			}
+
+			return
+		}
+
+		sort.Strings(keys)
+
+		if len(keys) != 2 || keys[0] != "keys-a" || keys[1] != "keys-b" {
+			t.Fatal("Unexpected keys", keys)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		items := map[string][]byte{
+			"purge-a":   []byte("a"),
+			"purge-b":   []byte("b"),
+			"purged-no": []byte("c"),
+		}
+
+		if err := p.SetMulti(items, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := p.Purge("purge-")
+
+		if err == ErrNotSupported {
+			t.Skip("Purge not supported")
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if discards {
+			return
+		}
+
+		if n != 2 {
+			t.Fatal("Expected 2 purged keys, got", n)
+		}
+
+		if _, err := p.Get("purge-a"); err != ErrNotFound {
+			t.Fatal("Expected purged key to be gone, got", err)
+		}
+
+		if _, err := p.Get("purged-no"); err != nil {
+			t.Fatal("Expected key outside the prefix to remain, got", err)
+		}
+	})
+}
+
+func Test_NullCache(t *testing.T) {
+	testProvider(t, &NullCache{}, true)
+}
+
+func Test_Gcache(t *testing.T) {
+	testProvider(t, NewGcache(&url.URL{Scheme: "gcache"}), false)
+}
+
+func Test_RedisCache(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	c, err := NewRedisCache(&url.URL{Scheme: "redis", Host: s.Addr()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testProvider(t, c, false)
+}
+
+func Test_Memcached(t *testing.T) {
+	addr := runFakeMemcached(t)
+
+	testProvider(t, NewMemcached(&url.URL{Scheme: "memcached", Host: addr}), false)
+}
+
+func Test_ForURI(t *testing.T) {
+	for uri, expected := range map[string]Provider{
+		"none":              &NullCache{},
+		"gcache://?size=16": &Gcache{},
+	} {
+		p, err := ForURI(uri)
+
+		if err != nil {
+			t.Fatal(uri, err)
+		}
+
+		if reflect.TypeOf(p) != reflect.TypeOf(expected) {
+			t.Fatalf("Expected %T for %s, got %T", expected, uri, p)
+		}
+	}
+}
+
+func Test_ForURIErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens on the address once closed
+	addr := l.Addr().String()
+	l.Close()
+
+	for _, uri := range []string{
+		"redsi://localhost:6379",
+		"redis://localhost?pool_size=many",
+		"redis://" + addr + "?dial_timeout=100ms",
+		"memcached://" + addr,
+		"%gh&%ij",
+	} {
+		if p, err := ForURI(uri); err == nil {
+			t.Fatalf("Expected an error for %s, got %T", uri, p)
+		}
+	}
+}
+
+// unregister removes scheme, so tests registering schemes can run again.
+func unregister(scheme string) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	delete(factories, scheme)
+}
+
+func Test_Register(t *testing.T) {
+	Register("test", func(u *url.URL) (Provider, error) {
+		return &NullCache{}, nil
+	})
+
+	t.Cleanup(func() {
+		unregister("test")
+	})
+
+	if _, err := ForURI("test://"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected registering a scheme twice to panic")
+		}
+	}()
+
+	Register("test", func(u *url.URL) (Provider, error) {
+		return &NullCache{}, nil
+	})
+}
+
+// closeCounter is a provider counting how many times it is closed.
+type closeCounter struct {
+	NullCache
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+
+	return nil
+}
+
+func Test_Close(t *testing.T) {
+	l1, l2 := &closeCounter{}, &closeCounter{}
+
+	compressed, err := NewCompressed(NewTiered(l1, l2, time.Second), "gzip", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Close(compressed); err != nil {
+		t.Fatal(err)
+	}
+
+	if l1.closed != 1 || l2.closed != 1 {
+		t.Fatal("Expected both tiers to be closed once, got", l1.closed, l2.closed)
+	}
+
+	if err := Close(&NullCache{}); err != nil {
+		t.Fatal("Expected providers without Close to be ignored, got", err)
+	}
+
+	s := miniredis.RunT(t)
+
+	p, err := ForURI("redis://" + s.Addr())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Close(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Get("key"); err == nil {
+		t.Fatal("Expected a closed redis cache to fail")
+	}
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"errors"
+	"github.com/go-redis/redis"
+	"net/url"
+)
+
+var (
+	errClusterDB = errors.New("redis cluster only supports db 0")
+)
+
+func init() {
+	Register("redis-cluster", func(u *url.URL) (Provider, error) {
+		return NewRedisClusterCache(u)
+	})
+}
+
+// NewRedisClusterCache creates a cluster client from a uri such as redis-cluster://:pass@host1:7000,host2:7000.
+// The remaining options are the same as for redis uris and apply to every node, with route_by_latency
+// and route_randomly allowing reads from replicas.
+func NewRedisClusterCache(uri *url.URL) (*RedisCache, error) {
+	opts, err := redisOptions(uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.DB != 0 {
+		return nil, errClusterDB
+	}
+
+	q := uri.Query()
+
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:          redisAddrs(uri.Host, "6379"),
+		RouteByLatency: q.Get("route_by_latency") == "true",
+		RouteRandomly:  q.Get("route_randomly") == "true",
+		OnConnect:      opts.OnConnect,
+		Password:       opts.Password,
+		MaxRetries:     opts.MaxRetries,
+		DialTimeout:    opts.DialTimeout,
+		ReadTimeout:    opts.ReadTimeout,
+		WriteTimeout:   opts.WriteTimeout,
+		PoolSize:       opts.PoolSize,
+		MinIdleConns:   opts.MinIdleConns,
+		MaxConnAge:     opts.MaxConnAge,
+		PoolTimeout:    opts.PoolTimeout,
+		IdleTimeout:    opts.IdleTimeout,
+		TLSConfig:      opts.TLSConfig,
+	})
+
+	return &RedisCache{client: client, forEachNode: client.ForEachMaster}, nil
+}
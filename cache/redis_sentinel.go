@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"errors"
+	"github.com/go-redis/redis"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var (
+	errNoSentinelMaster = errors.New("redis sentinel uri requires a master name")
+)
+
+func init() {
+	Register("redis-sentinel", func(u *url.URL) (Provider, error) {
+		return NewRedisSentinelCache(u)
+	})
+}
+
+// NewRedisSentinelCache creates a client following the master monitored by sentinels,
+// from a uri such as redis-sentinel://:pass@host1:26379,host2:26379/0?master=mymaster.
+// The remaining options are the same as for redis uris, and apply to the master connection.
+func NewRedisSentinelCache(uri *url.URL) (*RedisCache, error) {
+	masterName := uri.Query().Get("master")
+
+	if masterName == "" {
+		return nil, errNoSentinelMaster
+	}
+
+	opts, err := redisOptions(uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    masterName,
+		SentinelAddrs: redisAddrs(uri.Host, "26379"),
+		OnConnect:     opts.OnConnect,
+		Password:      opts.Password,
+		DB:            opts.DB,
+		MaxRetries:    opts.MaxRetries,
+		DialTimeout:   opts.DialTimeout,
+		ReadTimeout:   opts.ReadTimeout,
+		WriteTimeout:  opts.WriteTimeout,
+		PoolSize:      opts.PoolSize,
+		MinIdleConns:  opts.MinIdleConns,
+		MaxConnAge:    opts.MaxConnAge,
+		PoolTimeout:   opts.PoolTimeout,
+		IdleTimeout:   opts.IdleTimeout,
+		TLSConfig:     opts.TLSConfig,
+	})
+
+	return newRedisCache(client), nil
+}
+
+// redisAddrs splits a comma separated host list, adding defaultPort where missing.
+func redisAddrs(hosts, defaultPort string) []string {
+	addrs := make([]string, 0)
+
+	for _, host := range strings.Split(hosts, ",") {
+		if host == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, defaultPort)
+		}
+
+		addrs = append(addrs, host)
+	}
+
+	if len(addrs) == 0 {
+		addrs = append(addrs, net.JoinHostPort("localhost", defaultPort))
+	}
+
+	return addrs
+}
@@ -0,0 +1,229 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseURL(t *testing.T, uri string) *url.URL {
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+func Test_RedisOptions(t *testing.T) {
+	opts, err := redisOptions(mustParseURL(t, "rediss://:secret@redis.example.com/2?pool_size=50&dial_timeout=2s&read_timeout=500ms"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Addr != "redis.example.com:6379" {
+		t.Fatal("Unexpected address", opts.Addr)
+	}
+
+	if opts.Password != "secret" || opts.DB != 2 {
+		t.Fatal("Unexpected credentials", opts.Password, opts.DB)
+	}
+
+	if opts.TLSConfig == nil {
+		t.Fatal("Expected tls to be enabled")
+	}
+
+	if opts.PoolSize != 50 || opts.DialTimeout != 2*time.Second || opts.ReadTimeout != 500*time.Millisecond {
+		t.Fatal("Unexpected pool options", opts.PoolSize, opts.DialTimeout, opts.ReadTimeout)
+	}
+}
+
+func Test_RedisOptionsUnix(t *testing.T) {
+	opts, err := redisOptions(mustParseURL(t, "redis+unix:///var/run/redis.sock?db=3&password=secret"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Network != "unix" || opts.Addr != "/var/run/redis.sock" {
+		t.Fatal("Unexpected address", opts.Network, opts.Addr)
+	}
+
+	if opts.DB != 3 || opts.Password != "secret" {
+		t.Fatal("Unexpected credentials", opts.DB, opts.Password)
+	}
+}
+
+func Test_RedisOptionsInvalid(t *testing.T) {
+	for _, uri := range []string{
+		"redis://localhost/db",
+		"redis://localhost?pool_size=many",
+		"redis://localhost?dial_timeout=2",
+		"redis://localhost?tls=maybe",
+	} {
+		if _, err := redisOptions(mustParseURL(t, uri)); err == nil {
+			t.Fatal("Expected an error for", uri)
+		}
+	}
+}
+
+func Test_RedisCacheACL(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	s.RequireUserAuth("owapi", "secret")
+
+	c, err := NewRedisCache(mustParseURL(t, "redis://owapi:secret@"+s.Addr()+"/1"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Set("key", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Select(1)
+
+	if v, err := s.Get("key"); err != nil || v != "value" {
+		t.Fatal("Expected the value in db 1, got", v, err)
+	}
+}
+
+func Test_RedisClusterCache(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	c, err := NewRedisClusterCache(mustParseURL(t, "redis-cluster://"+s.Addr()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testProvider(t, c, false)
+}
+
+func Test_RedisSentinelCache(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	sentinel := runFakeSentinel(t, "mymaster", s.Host(), s.Port())
+
+	c, err := NewRedisSentinelCache(mustParseURL(t, "redis-sentinel://"+sentinel+"?master=mymaster"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testProvider(t, c, false)
+}
+
+func Test_RedisSentinelCacheMaster(t *testing.T) {
+	if _, err := NewRedisSentinelCache(mustParseURL(t, "redis-sentinel://localhost")); err != errNoSentinelMaster {
+		t.Fatal("Expected a missing master error, got", err)
+	}
+}
+
+// runFakeSentinel answers the sentinel commands go-redis uses to find the master.
+func runFakeSentinel(t *testing.T, masterName, host, port string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go serveFakeSentinel(conn, masterName, host, port)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func serveFakeSentinel(conn net.Conn, masterName, host, port string) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		args, err := readRESPCommand(r)
+
+		if err != nil {
+			return
+		}
+
+		switch strings.ToLower(strings.Join(args[:min(len(args), 2)], " ")) {
+		case "sentinel get-master-addr-by-name":
+			if args[2] == masterName {
+				fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+			} else {
+				conn.Write([]byte("*-1\r\n"))
+			}
+		case "sentinel sentinels":
+			conn.Write([]byte("*0\r\n"))
+		case "subscribe +switch-master":
+			conn.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$14\r\n+switch-master\r\n:1\r\n"))
+		default:
+			if strings.EqualFold(args[0], "ping") {
+				conn.Write([]byte("+PONG\r\n"))
+			} else {
+				conn.Write([]byte("-ERR unknown command\r\n"))
+			}
+		}
+	}
+}
+
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+
+	args := make([]string, n)
+
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, size+2)
+
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+
+		args[i] = string(b[:size])
+	}
+
+	return args, nil
+}
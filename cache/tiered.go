@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"errors"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultL1TTL = 30 * time.Second
+)
+
+var (
+	errTieredURIs = errors.New("tiered cache requires both l1 and l2 uris")
+)
+
+func init() {
+	Register("tiered", func(u *url.URL) (Provider, error) {
+		return NewTieredFromURI(u)
+	})
+}
+
+// Tiered reads through a local L1 provider in front of a shared L2 provider.
+// L1 entries live at most l1TTL, which bounds how long other replicas keep serving a deleted key.
+type Tiered struct {
+	l1, l2 Provider
+	l1TTL  time.Duration
+}
+
+func NewTiered(l1, l2 Provider, l1TTL time.Duration) *Tiered {
+	return &Tiered{l1: l1, l2: l2, l1TTL: l1TTL}
+}
+
+// NewTieredFromURI creates both tiers from a uri such as tiered://?l1=gcache://?size=5000&l2=redis://host&l1_ttl=30s.
+// Nested uris with more than one parameter of their own have to be query escaped.
+func NewTieredFromURI(u *url.URL) (*Tiered, error) {
+	q := u.Query()
+
+	if q.Get("l1") == "" || q.Get("l2") == "" {
+		return nil, errTieredURIs
+	}
+
+	l1TTL := defaultL1TTL
+
+	if s := q.Get("l1_ttl"); s != "" {
+		var err error
+
+		if l1TTL, err = time.ParseDuration(s); err != nil {
+			return nil, err
+		}
+	}
+
+	l1, err := ForURI(q.Get("l1"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	l2, err := ForURI(q.Get("l2"))
+
+	if err != nil {
+		Close(l1)
+
+		return nil, err
+	}
+
+	return NewTiered(l1, l2, l1TTL), nil
+}
+
+// L2 returns the shared provider behind the L1 provider.
+func (t *Tiered) L2() Provider {
+	return t.l2
+}
+
+// l1Duration caps d to the L1 ttl.
+func (t *Tiered) l1Duration(d time.Duration) time.Duration {
+	if d <= 0 || d > t.l1TTL {
+		return t.l1TTL
+	}
+
+	return d
+}
+
+func (t *Tiered) Get(key string) ([]byte, error) {
+	if b, err := t.l1.Get(key); err == nil {
+		return b, nil
+	}
+
+	b, err := t.l2.Get(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.l1.Set(key, b, t.l1TTL)
+
+	return b, nil
+}
+
+func (t *Tiered) Set(key string, b []byte, d time.Duration) error {
+	if err := t.l2.Set(key, b, d); err != nil {
+		return err
+	}
+
+	return t.l1.Set(key, b, t.l1Duration(d))
+}
+
+func (t *Tiered) Delete(key string) error {
+	if err := t.l2.Delete(key); err != nil {
+		return err
+	}
+
+	return t.l1.Delete(key)
+}
+
+func (t *Tiered) TTL(key string) (time.Duration, error) {
+	return t.l2.TTL(key)
+}
+
+func (t *Tiered) GetMulti(keys []string) (map[string][]byte, error) {
+	m, err := t.l1.GetMulti(keys)
+
+	if err != nil {
+		m = make(map[string][]byte)
+	}
+
+	missing := make([]string, 0)
+
+	for _, key := range keys {
+		if _, exists := m[key]; !exists {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) == 0 {
+		return m, nil
+	}
+
+	res, err := t.l2.GetMulti(missing)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) > 0 {
+		t.l1.SetMulti(res, t.l1TTL)
+	}
+
+	for key, b := range res {
+		m[key] = b
+	}
+
+	return m, nil
+}
+
+func (t *Tiered) SetMulti(items map[string][]byte, d time.Duration) error {
+	if err := t.l2.SetMulti(items, d); err != nil {
+		return err
+	}
+
+	return t.l1.SetMulti(items, t.l1Duration(d))
+}
+
+func (t *Tiered) Keys(prefix string) ([]string, error) {
+	return t.l2.Keys(prefix)
+}
+
+func (t *Tiered) Purge(prefix string) (int, error) {
+	n, err := t.l2.Purge(prefix)
+
+	if err != nil {
+		return n, err
+	}
+
+	if _, err := t.l1.Purge(prefix); err != nil && err != ErrNotSupported {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// Close closes both tiers.
+func (t *Tiered) Close() error {
+	return errors.Join(Close(t.l1), Close(t.l2))
+}
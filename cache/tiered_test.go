@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_Tiered(t *testing.T) {
+	testProvider(t, NewTiered(NewGcache(&url.URL{}), NewGcache(&url.URL{}), time.Minute), false)
+}
+
+func Test_TieredFillsL1(t *testing.T) {
+	p, err := ForURI("tiered://?l1=gcache://?size=16&l2=gcache://&l1_ttl=10s")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiered := p.(*Tiered)
+
+	if err := tiered.l2.Set("key", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := tiered.Get("key"); err != nil || string(b) != "value" {
+		t.Fatal("Expected the value from l2, got", string(b), err)
+	}
+
+	d, err := tiered.l1.TTL("key")
+
+	if err != nil {
+		t.Fatal("Expected l1 to be filled, got", err)
+	}
+
+	if d > 10*time.Second {
+		t.Fatal("Expected the l1 ttl to be capped, got", d)
+	}
+
+	if err := tiered.Set("set", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, _ := tiered.TTL("set"); d <= 10*time.Second {
+		t.Fatal("Expected the l2 ttl to be kept, got", d)
+	}
+}
+
+func Test_TieredURIErrors(t *testing.T) {
+	for _, uri := range []string{
+		"tiered://?l1=gcache://",
+		"tiered://?l1=gcache://&l2=redsi://localhost",
+		"tiered://?l1=gcache://&l2=gcache://&l1_ttl=soon",
+	} {
+		if _, err := ForURI(uri); err == nil {
+			t.Fatal("Expected an error for", uri)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/stoewer/go-strcase"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	configEnvPrefix = "OWAPI_"
+)
+
+var (
+	// settingsMu guards the settings changed when the configuration is reloaded
+	settingsMu sync.RWMutex
+
+	// reloadableFlags are the flags applied again when the configuration is reloaded, the others need a restart
+	reloadableFlags = map[string]bool{
+		"cacheTime":            true,
+		"staleWhileRevalidate": true,
+		"staleIfError":         true,
+		"negativeCacheTime":    true,
+		"rateLimit":            true,
+		"rateBurst":            true,
+		"trustedProxies":       true,
+		"tiers":                true,
+		"logLevel":             true,
+	}
+
+	nonNegativeFlags = []string{
+		"cacheTime", "staleWhileRevalidate", "staleIfError", "negativeCacheTime", "upstreamTimeout", "cacheTimeout",
+		"readTimeout", "writeTimeout", "idleTimeout", "shutdownTimeout",
+		"refreshInterval", "refreshJitter", "rateLimit", "traceSampleRate",
+	}
+
+	positiveFlags = []string{"refreshConcurrency", "rateBurst"}
+)
+
+// configKey returns the key of a flag in configuration files, such as cache_time for -cacheTime.
+func configKey(name string) string {
+	return strcase.SnakeCase(name)
+}
+
+// configEnv returns the environment variable of a flag, such as OWAPI_CACHE_TIME for -cacheTime.
+func configEnv(name string) string {
+	return configEnvPrefix + strings.ToUpper(configKey(name))
+}
+
+// commandLineFlags returns the names of the flags set on the command line.
+func commandLineFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	return set
+}
+
+// splitList splits a comma separated list, dropping blank entries.
+func splitList(s string) []string {
+	list := make([]string, 0)
+
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+
+	return list
+}
+
+// readConfigFile reads the settings of a YAML file, or a TOML file when its name ends in .toml,
+// with lists joined by commas as their flags expect.
+func readConfigFile(file string) (map[string]string, error) {
+	b, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+
+	if strings.EqualFold(filepath.Ext(file), ".toml") {
+		err = toml.Unmarshal(b, &raw)
+	} else {
+		err = yaml.Unmarshal(b, &raw)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	settings := make(map[string]string, len(raw))
+
+	for key, v := range raw {
+		s, err := configValue(v)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", file, key, err)
+		}
+
+		settings[key] = s
+	}
+
+	return settings, nil
+}
+
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		values := make([]string, len(v))
+
+		for i, item := range v {
+			s, err := configValue(item)
+
+			if err != nil {
+				return "", err
+			}
+
+			values[i] = s
+		}
+
+		return strings.Join(values, ","), nil
+	}
+
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// applyConfig sets the flags not set on the command line from the configuration file, when given,
+// and the OWAPI_* environment variables, after resetting them to their defaults.
+// The command line takes precedence over the environment, which takes precedence over the file.
+func applyConfig(fs *flag.FlagSet, set map[string]bool, file string, environ []string) error {
+	var settings map[string]string
+
+	if file != "" {
+		var err error
+
+		if settings, err = readConfigFile(file); err != nil {
+			return err
+		}
+	}
+
+	env := make(map[string]string)
+
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, configEnvPrefix) {
+			env[k] = v
+		}
+	}
+
+	known := make(map[string]bool)
+
+	var errs []error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		key := configKey(f.Name)
+
+		known[key] = true
+
+		if set[f.Name] || f.Name == "config" {
+			return
+		}
+
+		value, source := f.DefValue, ""
+
+		if v, exists := settings[key]; exists {
+			value, source = v, file+": "+key
+		}
+
+		if v, exists := env[configEnv(f.Name)]; exists {
+			value, source = v, configEnv(f.Name)
+		}
+
+		if err := fs.Set(f.Name, value); err != nil && source != "" {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q", source, value))
+		}
+	})
+
+	unknown := make([]string, 0)
+
+	for key := range settings {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+
+	sort.Strings(unknown)
+
+	for _, key := range unknown {
+		errs = append(errs, fmt.Errorf("%s: unknown setting %s", file, key))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateConfig checks the values of the flags, returning every problem found.
+func validateConfig(fs *flag.FlagSet) error {
+	var errs []error
+
+	for _, name := range nonNegativeFlags {
+		if flagInt(fs, name) < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", configKey(name)))
+		}
+	}
+
+	for _, name := range positiveFlags {
+		if flagInt(fs, name) < 1 {
+			errs = append(errs, fmt.Errorf("%s must be at least 1", configKey(name)))
+		}
+	}
+
+	if _, err := parseTrustedProxies(fs.Lookup("trustedProxies").Value.String()); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := parseTiers(fs.Lookup("tiers").Value.String()); err != nil {
+		errs = append(errs, err)
+	}
+
+	if flagInt(fs, "traceSampleRate") > 100 {
+		errs = append(errs, errors.New("trace_sample_rate must not exceed 100"))
+	}
+
+	switch exporter := fs.Lookup("traceExporter").Value.String(); exporter {
+	case "", "otlp", "stdout":
+	default:
+		errs = append(errs, fmt.Errorf("invalid trace exporter %q, expected otlp or stdout", exporter))
+	}
+
+	if _, err := parseLogLevel(fs.Lookup("logLevel").Value.String()); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := newLogHandler(io.Discard, fs.Lookup("logFormat").Value.String()); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(splitList(fs.Lookup("corsOrigins").Value.String())) == 0 {
+		errs = append(errs, errors.New("cors_origins must list at least one origin"))
+	}
+
+	if fs.Lookup("cache").Value.String() == "" {
+		errs = append(errs, errors.New("cache must be set, use none to disable caching"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// flagInt returns the value of the int flag name in fs.
+func flagInt(fs *flag.FlagSet, name string) int {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(int)
+}
+
+// applySettings copies the reloadable settings from their flags in fs to the values used while serving.
+func applySettings(fs *flag.FlagSet) {
+	seconds := func(name string) time.Duration {
+		return time.Duration(flagInt(fs, name)) * time.Second
+	}
+
+	settingsMu.Lock()
+
+	cacheTime = seconds("cacheTime")
+
+	staleWhileRevalidate = seconds("staleWhileRevalidate")
+	staleIfError = seconds("staleIfError")
+
+	negativeCacheTime = seconds("negativeCacheTime")
+
+	settingsMu.Unlock()
+
+	// These were validated along with the rest of the configuration
+	trustedProxies, _ := parseTrustedProxies(fs.Lookup("trustedProxies").Value.String())
+	tiers, _ := parseTiers(fs.Lookup("tiers").Value.String())
+	level, _ := parseLogLevel(fs.Lookup("logLevel").Value.String())
+
+	logLevel.Set(level)
+
+	if requestLimiter != nil {
+		requestLimiter.Configure(rateLimit{perMinute: flagInt(fs, "rateLimit"), burst: flagInt(fs, "rateBurst")}, trustedProxies)
+	}
+
+	if apiKeys != nil {
+		apiKeys.SetTiers(tiers)
+	}
+}
+
+// reloadConfig reads the configuration file and environment again and applies the reloadable settings.
+// Changes to other settings are logged and wait for a restart. An invalid configuration is not applied.
+func reloadConfig(fs *flag.FlagSet, set map[string]bool, file string) error {
+	before := make(map[string]string)
+
+	fs.VisitAll(func(f *flag.Flag) {
+		before[f.Name] = f.Value.String()
+	})
+
+	err := applyConfig(fs, set, file, os.Environ())
+
+	if err == nil {
+		err = validateConfig(fs)
+	}
+
+	if err != nil {
+		for name, value := range before {
+			fs.Set(name, value)
+		}
+
+		return err
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() != before[f.Name] && !reloadableFlags[f.Name] {
+			slog.Warn("Setting changed, it will apply after a restart", "setting", configKey(f.Name))
+
+			// Keep reporting the value in use
+			fs.Set(f.Name, before[f.Name])
+		}
+	})
+
+	applySettings(fs)
+
+	return nil
+}
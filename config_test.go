@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("owapi", flag.ContinueOnError)
+
+	fs.String("config", "", "")
+	fs.String("bind-address", ":8080", "")
+	fs.String("cache", "redis://localhost:6379", "")
+	fs.String("corsOrigins", "*", "")
+	fs.String("trustedProxies", "", "")
+	fs.String("tiers", "free=120:30", "")
+	fs.String("logLevel", "info", "")
+	fs.String("logFormat", "json", "")
+	fs.String("traceExporter", "", "")
+
+	for _, name := range nonNegativeFlags {
+		fs.Int(name, 0, "")
+	}
+
+	for _, name := range positiveFlags {
+		fs.Int(name, 1, "")
+	}
+
+	return fs
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func Test_ApplyConfig(t *testing.T) {
+	yamlFile := writeConfigFile(t, "config.yaml", `
+bind_address: ":9090"
+cache_time: 120
+rate_limit: 30
+rate_burst: 10
+cors_origins:
+  - https://example.com
+  - https://ow-api.com
+`)
+
+	tomlFile := writeConfigFile(t, "config.toml", `
+bind_address = ":9090"
+cache_time = 120
+rate_limit = 30
+rate_burst = 10
+cors_origins = ["https://example.com", "https://ow-api.com"]
+`)
+
+	for _, file := range []string{yamlFile, tomlFile} {
+		t.Run(filepath.Ext(file), func(t *testing.T) {
+			fs := testFlagSet()
+
+			if err := fs.Parse([]string{"-rateBurst", "5"}); err != nil {
+				t.Fatal(err)
+			}
+
+			environ := []string{"OWAPI_RATE_LIMIT=90", "OWAPI_RATE_BURST=50", "HOME=/root"}
+
+			if err := applyConfig(fs, commandLineFlags(fs), file, environ); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := map[string]string{
+				"bind-address": ":9090",
+				"cacheTime":    "120",
+				"corsOrigins":  "https://example.com,https://ow-api.com",
+				"rateLimit":    "90",
+				"rateBurst":    "5",
+				"cache":        "redis://localhost:6379",
+			}
+
+			for name, value := range expected {
+				if actual := fs.Lookup(name).Value.String(); actual != value {
+					t.Errorf("Expected %s to be %q, got %q", name, value, actual)
+				}
+			}
+		})
+	}
+}
+
+func Test_ApplyConfigErrors(t *testing.T) {
+	file := writeConfigFile(t, "config.yaml", "cache_time: soon\ncache_tim: 60\n")
+
+	fs := testFlagSet()
+
+	err := applyConfig(fs, nil, file, []string{"OWAPI_RATE_LIMIT=lots"})
+
+	if err == nil {
+		t.Fatal("Expected invalid settings to fail")
+	}
+
+	for _, problem := range []string{"cache_time", "unknown setting cache_tim", "OWAPI_RATE_LIMIT"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q to mention %s", err, problem)
+		}
+	}
+}
+
+func Test_ValidateConfig(t *testing.T) {
+	fs := testFlagSet()
+
+	if err := validateConfig(fs); err != nil {
+		t.Fatal("Expected defaults to be valid:", err)
+	}
+
+	fs.Set("cacheTime", "-1")
+	fs.Set("rateBurst", "0")
+	fs.Set("trustedProxies", "10.0.0.0/33")
+	fs.Set("tiers", "free")
+	fs.Set("corsOrigins", " , ")
+	fs.Set("logLevel", "loud")
+
+	err := validateConfig(fs)
+
+	if err == nil {
+		t.Fatal("Expected an invalid configuration to fail")
+	}
+
+	for _, problem := range []string{"cache_time", "rate_burst", "trusted proxy", "tier", "cors_origins", "log level"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q to mention %s", err, problem)
+		}
+	}
+}
+
+func Test_ReloadConfig(t *testing.T) {
+	oldSettings := currentCacheSettings()
+	oldLevel := logLevel.Level()
+
+	t.Cleanup(func() {
+		cacheTime, staleWhileRevalidate = oldSettings.fresh, oldSettings.staleWhileRevalidate
+		staleIfError, negativeCacheTime = oldSettings.staleIfError, oldSettings.negative
+
+		logLevel.Set(oldLevel)
+	})
+
+	fs := testFlagSet()
+
+	set := commandLineFlags(fs)
+
+	file := writeConfigFile(t, "config.yaml", "cache_time: 30\nbind_address: \":9999\"\n")
+
+	if err := reloadConfig(fs, set, file); err != nil {
+		t.Fatal(err)
+	}
+
+	if currentCacheSettings().fresh != 30*time.Second {
+		t.Error("Expected the cache time to be reloaded")
+	}
+
+	if bind := fs.Lookup("bind-address").Value.String(); bind != ":8080" {
+		t.Error("Expected the bind address to wait for a restart, got", bind)
+	}
+
+	os.WriteFile(file, []byte("cache_time: -5\n"), 0600)
+
+	if err := reloadConfig(fs, set, file); err == nil {
+		t.Fatal("Expected an invalid configuration not to be applied")
+	}
+
+	if flagInt(fs, "cacheTime") != 30 || currentCacheSettings().fresh != 30*time.Second {
+		t.Error("Expected the previous configuration to be kept")
+	}
+}
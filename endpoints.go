@@ -4,75 +4,43 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
+	jsonpatch "git.meow.tf/ow-api/ow-api/json-patch"
 	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel/attribute"
 	"net/http"
 	"sort"
 	"strings"
 )
 
-func stats(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	data, err := statsResponse(w, r, ps, nil)
-
-	if err != nil {
-		writeError(w, err)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
+var (
+	errEmptyHeroName = &apiError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Detail: "Hero names must not be empty"}
+)
 
-	w.Write(data)
+func stats(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	serveStats(w, r, ps, "", nil)
 }
 
 func profile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	cacheKey := generateCacheKey(r, ps) + "-profile"
 
-	res, err := cacheProvider.Get(cacheKey)
-
-	if res != nil && err == nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(res)
-		return
-	}
-
 	// Cache result for profile specifically
-	data, err := statsResponse(w, r, ps, profilePatch)
-
-	if err != nil {
-		writeError(w, err)
-		return
-	}
-
-	if cacheTime > 0 {
-		cacheProvider.Set(cacheKey, data, cacheTime)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-
-	w.Write(data)
+	serveStats(w, r, ps, cacheKey, profilePatch)
 }
 
 func heroes(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	names := strings.Split(ps.ByName("heroes"), ",")
 
-	if len(names) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		writeError(w, errors.New("name list must contain at least one hero"))
-		return
+	for _, name := range names {
+		if name == "" {
+			writeError(w, errEmptyHeroName)
+			return
+		}
 	}
 
 	sort.Strings(names)
 
 	cacheKey := generateCacheKey(r, ps) + "-heroes-" + hex.EncodeToString(md5.New().Sum([]byte(strings.Join(names, ","))))
 
-	res, err := cacheProvider.Get(cacheKey)
-
-	if res != nil && err == nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(res)
-		return
-	}
-
 	nameMap := make(map[string]bool)
 
 	for _, name := range names {
@@ -99,24 +67,35 @@ func heroes(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		}
 	}
 
+	_, span := startSpan(r.Context(), "patch.build", attribute.Int("patch.operations", len(ops)))
+
 	patch, err := patchFromOperations(ops)
 
+	endSpan(span, err)
+
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		patchFailures.WithLabelValues("heroes").Inc()
+		requestLogger(r.Context()).Error("Unable to create heroes patch", "heroes", names, "error", err)
 		writeError(w, err)
 		return
 	}
 
 	// Create a patch to remove all but specified heroes
-	data, err := statsResponse(w, r, ps, patch)
+	serveStats(w, r, ps, cacheKey, patch)
+}
+
+// serveStats writes the response of statsResponse, or 304 Not Modified when the client's copy is current.
+func serveStats(w http.ResponseWriter, r *http.Request, ps httprouter.Params, key string, patch *jsonpatch.Patch) {
+	data, err := statsResponse(w, r, ps, key, patch)
 
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 
-	if cacheTime > 0 {
-		cacheProvider.Set(cacheKey, data, cacheTime)
+	if notModified(r, w.Header()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"git.meow.tf/ow-api/ow-api/cache"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupTestServer(t *testing.T) (*httptest.Server, *fixtureFetcher) {
+	fetcher := newFixtureFetcher()
+
+	oldFetcher, oldProvider, oldCacheTime, oldHeroNames := statsFetcher, cacheProvider, cacheTime, heroNames
+	oldStaleWhileRevalidate, oldStaleIfError, oldNegativeCacheTime := staleWhileRevalidate, staleIfError, negativeCacheTime
+
+	statsFetcher = fetcher
+	cacheProvider = &cache.NullCache{}
+	cacheTime = 0
+	heroNames = []string{"ana", "ashe"}
+
+	srv := httptest.NewServer(newRouter())
+
+	t.Cleanup(func() {
+		srv.Close()
+
+		statsFetcher, cacheProvider, cacheTime, heroNames = oldFetcher, oldProvider, oldCacheTime, oldHeroNames
+		staleWhileRevalidate, staleIfError, negativeCacheTime = oldStaleWhileRevalidate, oldStaleIfError, oldNegativeCacheTime
+	})
+
+	return srv, fetcher
+}
+
+func newTestCache(t *testing.T, uri string) cache.Provider {
+	p, err := cache.ForURI(uri)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func getJSON(t *testing.T, url string, expectedStatus int) map[string]interface{} {
+	_, m := getResponse(t, url, expectedStatus)
+
+	return m
+}
+
+func getResponse(t *testing.T, url string, expectedStatus int) (*http.Response, map[string]interface{}) {
+	res, err := http.Get(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d, got %d", expectedStatus, res.StatusCode)
+	}
+
+	var m map[string]interface{}
+
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return res, m
+}
+
+func Test_StatsEndpoint(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	m := getJSON(t, srv.URL+"/v2/stats/pc/cats-11481/complete", http.StatusOK)
+
+	if m["name"] != "cats" {
+		t.Fatal("Unexpected name", m["name"])
+	}
+
+	qp := m["quickPlayStats"].(map[string]interface{})
+
+	games, ok := qp["games"].(map[string]interface{})
+
+	if !ok {
+		t.Fatal("Expected quickPlayStats.games to be added")
+	}
+
+	if games["played"] != float64(100) || games["won"] != float64(50) {
+		t.Fatal("Unexpected games stats", games)
+	}
+
+	if _, ok := m["ratings"].([]interface{}); !ok {
+		t.Fatal("Expected v2 ratings to be a list")
+	}
+}
+
+func Test_StatsEndpointVersionThree(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	m := getJSON(t, srv.URL+"/v3/stats/pc/cats-11481/complete", http.StatusOK)
+
+	ratings, ok := m["ratings"].(map[string]interface{})
+
+	if !ok {
+		t.Fatal("Expected v3 ratings to be a map")
+	}
+
+	tank, ok := ratings["tank"].(map[string]interface{})
+
+	if !ok {
+		t.Fatal("Expected tank rating")
+	}
+
+	if _, exists := tank["role"]; exists {
+		t.Fatal("Expected role to be removed from rating")
+	}
+}
+
+func Test_ProfileEndpoint(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	m := getJSON(t, srv.URL+"/v2/stats/pc/cats-11481/profile", http.StatusOK)
+
+	qp := m["quickPlayStats"].(map[string]interface{})
+
+	if _, exists := qp["topHeroes"]; exists {
+		t.Fatal("Expected topHeroes to be removed")
+	}
+
+	if _, exists := qp["careerStats"]; exists {
+		t.Fatal("Expected careerStats to be removed")
+	}
+
+	if _, exists := qp["games"]; !exists {
+		t.Fatal("Expected games to be kept")
+	}
+}
+
+func Test_HeroesEndpoint(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	m := getJSON(t, srv.URL+"/v2/stats/pc/cats-11481/heroes/ana", http.StatusOK)
+
+	qp := m["quickPlayStats"].(map[string]interface{})
+
+	topHeroes := qp["topHeroes"].(map[string]interface{})
+
+	if _, exists := topHeroes["ana"]; !exists {
+		t.Fatal("Expected ana to be kept")
+	}
+
+	if _, exists := topHeroes["ashe"]; exists {
+		t.Fatal("Expected ashe to be removed")
+	}
+}
+
+func Test_EncodedBattleTag(t *testing.T) {
+	srv, fetcher := setupTestServer(t)
+
+	cacheProvider = newTestCache(t, "gcache://?size=16")
+	cacheTime = time.Minute
+
+	first := getJSON(t, srv.URL+"/v3/stats/pc/cats%2311481/complete", http.StatusOK)
+	second := getJSON(t, srv.URL+"/v3/stats/pc/cats-11481/complete", http.StatusOK)
+
+	if first["name"] != second["name"] {
+		t.Fatal("Expected an encoded # to be served as the same player, got", first["name"], second["name"])
+	}
+
+	if calls := fetcher.Calls(); calls != 1 {
+		t.Fatalf("Expected both forms of the tag to share a cache entry, got %d fetches", calls)
+	}
+}
+
+func Test_PlayerNotFound(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	m := getJSON(t, srv.URL+"/v2/stats/pc/missing-0000/complete", http.StatusNotFound)
+
+	if m["error"] == nil {
+		t.Fatal("Expected an error message")
+	}
+}
+
+func Test_StatsEndpointCacheHit(t *testing.T) {
+	srv, fetcher := setupTestServer(t)
+
+	cacheProvider = newTestCache(t, "gcache://?size=16")
+	cacheTime = time.Minute
+
+	first := getJSON(t, srv.URL+"/v3/stats/pc/cats-11481/complete", http.StatusOK)
+	second := getJSON(t, srv.URL+"/v3/stats/pc/cats-11481/complete", http.StatusOK)
+
+	if calls := fetcher.Calls(); calls != 1 {
+		t.Fatalf("Expected a warm cache to skip the upstream fetch, got %d fetches", calls)
+	}
+
+	if _, ok := second["ratings"].(map[string]interface{}); !ok {
+		t.Fatal("Expected cached v3 ratings to stay a map")
+	}
+
+	if first["name"] != second["name"] {
+		t.Fatal("Expected cached response to match the original")
+	}
+}
+
+func seedEntry(t *testing.T, key string, entry *cache.Entry) {
+	b, err := cache.EncodeEntry(entry)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cacheProvider.Set(key, b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_StaleWhileRevalidate(t *testing.T) {
+	srv, fetcher := setupTestServer(t)
+
+	cacheProvider = newTestCache(t, "gcache://?size=16")
+	cacheTime = time.Minute
+	staleWhileRevalidate = time.Minute
+
+	now := time.Now()
+
+	seedEntry(t, versionToString(VersionTwo)+"-pc-cats-11481", &cache.Entry{
+		Data:       []byte(`{"name":"stale"}`),
+		FreshUntil: now.Add(-time.Second),
+		StaleUntil: now.Add(time.Minute),
+	})
+
+	res, m := getResponse(t, srv.URL+"/v2/stats/pc/cats-11481/complete", http.StatusOK)
+
+	if m["name"] != "stale" {
+		t.Fatal("Expected the stale entry to be served, got", m["name"])
+	}
+
+	if !strings.HasPrefix(res.Header.Get("Warning"), "110") {
+		t.Fatal("Expected a stale warning, got", res.Header.Get("Warning"))
+	}
+
+	for i := 0; i < 100 && fetcher.Calls() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The refresh stores the entry right after fetching
+	for i := 0; i < 100; i++ {
+		res, m = getResponse(t, srv.URL+"/v2/stats/pc/cats-11481/complete", http.StatusOK)
+
+		if m["name"] == "cats" {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if m["name"] != "cats" {
+		t.Fatal("Expected the background refresh to replace the stale entry")
+	}
+
+	if res.Header.Get("Warning") != "" {
+		t.Fatal("Expected no warning on a fresh entry")
+	}
+}
+
+func Test_StaleIfError(t *testing.T) {
+	srv, fetcher := setupTestServer(t)
+
+	cacheProvider = newTestCache(t, "gcache://?size=16")
+	cacheTime = time.Minute
+	staleIfError = time.Minute
+
+	now := time.Now()
+
+	seedEntry(t, versionToString(VersionTwo)+"-pc-broken-3456", &cache.Entry{
+		Data:       []byte(`{"name":"broken"}`),
+		FreshUntil: now.Add(-time.Second),
+		StaleUntil: now.Add(time.Minute),
+	})
+
+	// The fixture fails to decode, standing in for an upstream failure
+	res, m := getResponse(t, srv.URL+"/v2/stats/pc/broken-3456/complete", http.StatusOK)
+
+	if fetcher.Calls() != 1 {
+		t.Fatal("Expected a synchronous refresh attempt")
+	}
+
+	if m["name"] != "broken" {
+		t.Fatal("Expected the stale entry to be served, got", m["name"])
+	}
+
+	if !strings.Contains(strings.Join(res.Header.Values("Warning"), ","), "111") {
+		t.Fatal("Expected a revalidation failed warning, got", res.Header.Values("Warning"))
+	}
+}
+
+// slowCache takes delay to answer every read and write.
+type slowCache struct {
+	cache.Provider
+
+	delay time.Duration
+}
+
+func (c *slowCache) Get(key string) ([]byte, error) {
+	time.Sleep(c.delay)
+
+	return c.Provider.Get(key)
+}
+
+func (c *slowCache) Set(key string, b []byte, d time.Duration) error {
+	time.Sleep(c.delay)
+
+	return c.Provider.Set(key, b, d)
+}
+
+func Test_CacheTimeout(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	oldCacheTimeout := cacheTimeout
+
+	t.Cleanup(func() {
+		cacheTimeout = oldCacheTimeout
+	})
+
+	cacheProvider = &slowCache{Provider: newTestCache(t, "gcache://?size=16"), delay: time.Second}
+	cacheTime = time.Minute
+	cacheTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+
+	getJSON(t, srv.URL+"/v3/stats/pc/cats-11481/complete", http.StatusOK)
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal("Expected a slow cache to be given up on, took", elapsed)
+	}
+}
+
+func Test_NegativeCache(t *testing.T) {
+	srv, fetcher := setupTestServer(t)
+
+	cacheProvider = newTestCache(t, "gcache://?size=16")
+	cacheTime = time.Minute
+	negativeCacheTime = time.Minute
+
+	getJSON(t, srv.URL+"/v2/stats/pc/missing-0000/complete", http.StatusNotFound)
+	getJSON(t, srv.URL+"/v2/stats/pc/missing-0000/profile", http.StatusNotFound)
+	getJSON(t, srv.URL+"/v2/stats/pc/missing-0000/complete", http.StatusNotFound)
+
+	if calls := fetcher.Calls(); calls != 1 {
+		t.Fatalf("Expected the missing player to be fetched once, got %d fetches", calls)
+	}
+
+	ttl, err := cacheProvider.TTL(versionToString(VersionTwo) + "-pc-missing-0000")
+
+	if err != nil || ttl > negativeCacheTime {
+		t.Fatal("Expected the negative entry to use the negative cache time, got", ttl, err)
+	}
+
+	// Private players are cached the same way, keeping their response
+	getJSON(t, srv.URL+"/v2/stats/pc/hidden-2345/complete", http.StatusOK)
+	m := getJSON(t, srv.URL+"/v2/stats/pc/hidden-2345/complete", http.StatusOK)
+
+	if calls := fetcher.Calls(); calls != 2 {
+		t.Fatalf("Expected the private player to be fetched once, got %d fetches", calls-1)
+	}
+
+	if m["private"] != true {
+		t.Fatal("Expected the private response to be replayed")
+	}
+}
+
+func Test_NegativeCacheWithoutCacheTime(t *testing.T) {
+	srv, fetcher := setupTestServer(t)
+
+	cacheProvider = newTestCache(t, "gcache://?size=16")
+	cacheTime = 0
+	negativeCacheTime = time.Minute
+
+	getJSON(t, srv.URL+"/v2/stats/pc/missing-0000/complete", http.StatusNotFound)
+	getJSON(t, srv.URL+"/v2/stats/pc/missing-0000/complete", http.StatusNotFound)
+
+	if calls := fetcher.Calls(); calls != 1 {
+		t.Fatalf("Expected the missing player to be cached by its own cache time, got %d fetches", calls)
+	}
+
+	getJSON(t, srv.URL+"/v2/stats/pc/cats-11481/complete", http.StatusOK)
+	getJSON(t, srv.URL+"/v2/stats/pc/cats-11481/complete", http.StatusOK)
+
+	if calls := fetcher.Calls(); calls != 3 {
+		t.Fatalf("Expected stats not to be cached without a cache time, got %d fetches", calls-1)
+	}
+}
+
+func Test_PrivateProfile(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	for _, path := range []string{"complete", "profile", "heroes/ana"} {
+		m := getJSON(t, srv.URL+"/v3/stats/pc/hidden-2345/"+path, http.StatusOK)
+
+		if m["private"] != true || m["name"] != "hidden#2345" {
+			t.Errorf("Expected the masthead of the private player on %s, got %v", path, m)
+		}
+
+		if _, exists := m["quickPlayStats"]; exists {
+			t.Errorf("Expected no stats for the private player on %s", path)
+		}
+	}
+
+	m := getJSON(t, srv.URL+"/v3/stats/pc/hidden-2345/profile?private=error", http.StatusForbidden)
+
+	if m["code"] != codePrivate {
+		t.Fatal("Expected a private error, got", m["code"])
+	}
+
+	getJSON(t, srv.URL+"/v3/stats/pc/cats-11481/profile?private=error", http.StatusOK)
+}
+
+func conditionalGet(t *testing.T, url string, header, value string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set(header, value)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	return res
+}
+
+func Test_ConditionalGet(t *testing.T) {
+	srv, fetcher := setupTestServer(t)
+
+	url := srv.URL + "/v3/stats/pc/cats-11481/profile"
+
+	res, _ := getResponse(t, url, http.StatusOK)
+
+	if cacheControl := res.Header.Get("Cache-Control"); cacheControl != "max-age=0" {
+		t.Fatal("Expected responses that aren't cached to expire immediately, got", cacheControl)
+	}
+
+	cacheProvider = newTestCache(t, "gcache://?size=16")
+	cacheTime = time.Minute
+
+	res, _ = getResponse(t, url, http.StatusOK)
+
+	etag, modified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+
+	if !strings.HasPrefix(etag, `"`) || modified == "" {
+		t.Fatalf("Expected a strong ETag and Last-Modified, got %s and %s", etag, modified)
+	}
+
+	if cacheControl := res.Header.Get("Cache-Control"); cacheControl != "max-age=59" && cacheControl != "max-age=60" {
+		t.Fatal("Expected the max-age to be the time left in the cache, got", cacheControl)
+	}
+
+	calls := fetcher.Calls()
+
+	tests := []struct {
+		header string
+		value  string
+		status int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other", W/` + etag, http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", modified, http.StatusNotModified},
+		{"If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusOK},
+	}
+
+	for _, test := range tests {
+		res := conditionalGet(t, url, test.header, test.value)
+
+		if res.StatusCode != test.status {
+			t.Errorf("Expected %s: %s to get %d, got %d", test.header, test.value, test.status, res.StatusCode)
+		}
+
+		if res.Header.Get("ETag") != etag {
+			t.Error("Expected the ETag of the cached payload, got", res.Header.Get("ETag"))
+		}
+	}
+
+	if fetcher.Calls() != calls {
+		t.Fatal("Expected conditional requests to be answered from the cache")
+	}
+}
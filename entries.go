@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"git.meow.tf/ow-api/ow-api/cache"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cacheStatus int
+
+const (
+	cacheMiss cacheStatus = iota
+	cacheHit
+	// cacheStale is an expired entry served while it is refreshed in the background
+	cacheStale
+	// cacheStaleError is an expired entry served because refreshing it failed
+	cacheStaleError
+)
+
+const (
+	// entryNotFound marks players that don't exist
+	entryNotFound = "notFound"
+	// entryPrivate marks private players, whose masthead is cached along with it
+	entryPrivate = "private"
+)
+
+var (
+	fillGroup callGroup
+)
+
+// cacheSettings holds the cache durations, which change when the configuration is reloaded.
+type cacheSettings struct {
+	fresh                time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	negative             time.Duration
+}
+
+func currentCacheSettings() cacheSettings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+
+	return cacheSettings{
+		fresh:                cacheTime,
+		staleWhileRevalidate: staleWhileRevalidate,
+		staleIfError:         staleIfError,
+		negative:             negativeCacheTime,
+	}
+}
+
+// newNegativeEntry creates an entry of kind, fresh for negativeCacheTime and never served stale.
+func newNegativeEntry(kind string, data []byte) *cache.Entry {
+	expires := time.Now().Add(currentCacheSettings().negative)
+
+	return &cache.Entry{Data: data, Kind: kind, FreshUntil: expires, StaleUntil: expires}
+}
+
+// enabled reports whether entries of kind are cached, negative entries by their own cache time.
+func (s cacheSettings) enabled(kind string) bool {
+	if kind != "" {
+		return s.negative > 0
+	}
+
+	return s.fresh > 0
+}
+
+// staleWindow returns how long entries are kept after they stop being fresh.
+func (s cacheSettings) staleWindow() time.Duration {
+	if s.staleIfError > s.staleWhileRevalidate {
+		return s.staleIfError
+	}
+
+	return s.staleWhileRevalidate
+}
+
+// cachedEntry returns the entry stored under key, calling fill to create it when missing or expired.
+// Expired entries are served while a background refresh runs within the stale-while-revalidate window,
+// and in place of a failed refresh within the stale-if-error window.
+// Background refreshes outlive the request, so they don't stop when ctx is cancelled.
+func cachedEntry(ctx context.Context, key string, fill func(ctx context.Context) (*cache.Entry, error)) (*cache.Entry, cacheStatus, error) {
+	var entry *cache.Entry
+
+	_, span := startSpan(ctx, "cache.get", attribute.String("cache.key", key))
+
+	if res, err := cacheGet(ctx, key); res != nil && err == nil {
+		entry, err = cache.DecodeEntry(res)
+
+		if err != nil {
+			entry = nil
+		}
+	}
+
+	span.SetAttributes(attribute.Bool("cache.found", entry != nil))
+	span.End()
+
+	now := time.Now()
+
+	settings := currentCacheSettings()
+
+	if entry != nil {
+		if entry.Fresh(now) {
+			return entry, cacheHit, nil
+		}
+
+		if now.Before(entry.FreshUntil.Add(settings.staleWhileRevalidate)) {
+			go fillEntry(context.WithoutCancel(ctx), key, fill)
+
+			return entry, cacheStale, nil
+		}
+	}
+
+	fresh, err := fillEntry(ctx, key, fill)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, cacheMiss, err
+		}
+
+		if entry != nil && now.Before(entry.FreshUntil.Add(settings.staleIfError)) {
+			requestLogger(ctx).Warn("Serving stale entry after refresh failure", "key", key, "error", err)
+
+			return entry, cacheStaleError, nil
+		}
+
+		return nil, cacheMiss, err
+	}
+
+	return fresh, cacheMiss, nil
+}
+
+// cacheGet reads key from the cache provider, giving up once ctx is done or after cacheTimeout,
+// so a slow cache doesn't hold requests past their deadline. The read itself isn't cancelled.
+func cacheGet(ctx context.Context, key string) ([]byte, error) {
+	type result struct {
+		b   []byte
+		err error
+	}
+
+	p, done := cacheProvider, make(chan result, 1)
+
+	go func() {
+		b, err := p.Get(key)
+
+		done <- result{b, err}
+	}()
+
+	ctx, cancel := withCacheTimeout(ctx)
+	defer cancel()
+
+	select {
+	case res := <-done:
+		return res.b, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// cacheSet stores key in the cache provider, giving up waiting once ctx is done or after cacheTimeout.
+func cacheSet(ctx context.Context, key string, b []byte, d time.Duration) error {
+	p, done := cacheProvider, make(chan error, 1)
+
+	go func() {
+		done <- p.Set(key, b, d)
+	}()
+
+	ctx, cancel := withCacheTimeout(ctx)
+	defer cancel()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withCacheTimeout bounds ctx by cacheTimeout, unless it is 0.
+func withCacheTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cacheTimeout > 0 {
+		return context.WithTimeout(ctx, cacheTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// fillEntry creates the entry for key using fill and stores it, sharing the work between concurrent callers.
+// Entries returned by fill without freshness information become fresh for cacheTime,
+// and those without a modification time are considered fetched now.
+func fillEntry(ctx context.Context, key string, fill func(ctx context.Context) (*cache.Entry, error)) (*cache.Entry, error) {
+	v, err, _ := fillGroup.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		ctx, span := startSpan(ctx, "cache.fill", attribute.String("cache.key", key))
+		defer span.End()
+
+		entry, err := fill(ctx)
+
+		if err != nil {
+			spanError(span, err)
+			return nil, err
+		}
+
+		settings := currentCacheSettings()
+
+		if entry.FreshUntil.IsZero() {
+			entry.FreshUntil = time.Now().Add(settings.fresh)
+			entry.StaleUntil = entry.FreshUntil.Add(settings.staleWindow())
+		}
+
+		if entry.Modified.IsZero() {
+			entry.Modified = time.Now()
+		}
+
+		if entry.ETag == "" && entry.Data != nil {
+			entry.ETag = cache.ETag(entry.Data)
+		}
+
+		if ttl := time.Until(entry.StaleUntil); settings.enabled(entry.Kind) && ttl > 0 {
+			b, err := cache.EncodeEntry(entry)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if err := cacheSet(ctx, key, b, ttl); err != nil {
+				spanError(span, err)
+			}
+		}
+
+		return entry, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*cache.Entry), nil
+}
+
+// writeCacheHeaders adds the validators of entry, a max-age of its remaining freshness,
+// and marks stale responses with the matching Warning headers.
+func writeCacheHeaders(w http.ResponseWriter, entry *cache.Entry, status cacheStatus) {
+	h := w.Header()
+
+	now := time.Now()
+
+	etag := entry.ETag
+
+	// Entries cached before they had validators
+	if etag == "" {
+		etag = cache.ETag(entry.Data)
+	}
+
+	h.Set("ETag", etag)
+
+	if !entry.Modified.IsZero() {
+		h.Set("Last-Modified", entry.Modified.UTC().Format(http.TimeFormat))
+	}
+
+	// Entries without freshness information, cached before entries existed, aren't cached by clients
+	var maxAge time.Duration
+
+	if !entry.FreshUntil.IsZero() {
+		maxAge = entry.FreshUntil.Sub(now)
+	}
+
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	h.Set("Cache-Control", "max-age="+strconv.Itoa(int(maxAge.Seconds())))
+
+	if status == cacheStaleError {
+		h.Add("Warning", `111 - "Revalidation Failed"`)
+	}
+
+	if !entry.Fresh(now) {
+		h.Add("Warning", `110 - "Response is Stale"`)
+	}
+}
+
+// notModified reports whether the response validators in h match the conditional headers of r,
+// with If-None-Match taking precedence over If-Modified-Since.
+func notModified(r *http.Request, h http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := h.Get("ETag")
+
+		for _, candidate := range strings.Split(match, ",") {
+			// Weak comparison, as for GET requests
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+
+	return err == nil && !modified.After(since)
+}
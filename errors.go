@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ow-api/ovrstat/ovrstat"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	problemContentType = "application/problem+json"
+
+	// privateAsError is the value of the private query parameter answering private players with errPlayerPrivate
+	privateAsError = "error"
+
+	codeNotFound            = "not_found"
+	codePrivate             = "private"
+	codeInvalidTag          = "invalid_tag"
+	codeInvalidRequest      = "invalid_request"
+	codeUpstreamUnavailable = "upstream_unavailable"
+	codeUpstreamBlocked     = "upstream_blocked"
+	codeRateLimited         = "rate_limited"
+	codeInternal            = "internal"
+)
+
+var (
+	errPlayerPrivate = &apiError{Status: http.StatusForbidden, Code: codePrivate, Detail: "Player profile is private"}
+	errInvalidTag    = &apiError{Status: http.StatusBadRequest, Code: codeInvalidTag, Detail: "Invalid tag, expected a BattleTag such as Name-1234"}
+
+	// tagRegexp matches tags in their URL form, a name of letters and digits with an optional discriminator
+	tagRegexp = regexp.MustCompile(`^[\p{L}\p{M}\p{N}]{1,32}(-\d{1,8})?$`)
+
+	// statusCodes are the codes of errors served with a status but no code of their own
+	statusCodes = map[int]string{
+		http.StatusBadRequest:          codeInvalidRequest,
+		http.StatusUnauthorized:        "unauthorized",
+		http.StatusForbidden:           "forbidden",
+		http.StatusNotFound:            codeNotFound,
+		http.StatusTooManyRequests:     codeRateLimited,
+		http.StatusNotImplemented:      "not_implemented",
+		http.StatusBadGateway:          codeUpstreamUnavailable,
+		http.StatusServiceUnavailable:  codeUpstreamBlocked,
+		http.StatusInternalServerError: codeInternal,
+	}
+)
+
+// apiError is an error served to clients with its status and a machine readable code.
+type apiError struct {
+	Status int
+	Code   string
+	Detail string
+
+	// Err is the cause, which isn't shown to clients
+	Err error
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return e.Detail + ": " + e.Err.Error()
+	}
+
+	return e.Detail
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// problemObject is an RFC 7807 problem. Error repeats the detail for clients of the previous {"error": ...} bodies.
+type problemObject struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+	Error  string `json:"error"`
+}
+
+// upstreamStatusError is returned for upstream responses refusing to serve the scrape.
+type upstreamStatusError struct {
+	StatusCode int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream responded with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// blockDetectingTransport fails requests answered with 403 Forbidden or 429 Too Many Requests,
+// which Blizzard serves when blocking scrapes and ovrstat would otherwise try to parse.
+type blockDetectingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *blockDetectingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests {
+		res.Body.Close()
+
+		return nil, &upstreamStatusError{StatusCode: res.StatusCode}
+	}
+
+	return res, nil
+}
+
+// normalizeTag returns tag in its URL form, replacing the # of BattleTags such as Name%2311481 with a -.
+func normalizeTag(tag string) string {
+	return strings.Replace(tag, "#", "-", -1)
+}
+
+// validTag reports whether tag, in its URL form, could be a BattleTag.
+func validTag(tag string) bool {
+	return tagRegexp.MatchString(tag)
+}
+
+// toAPIError returns the error served for err, classifying upstream failures by their cause.
+// Errors not classified are internal, and their cause isn't shown to clients.
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	if err == ovrstat.ErrPlayerNotFound {
+		return &apiError{Status: http.StatusNotFound, Code: codeNotFound, Detail: "Player not found", Err: err}
+	}
+
+	switch upstreamErrorClass(err) {
+	case "blocked":
+		return &apiError{Status: http.StatusServiceUnavailable, Code: codeUpstreamBlocked, Detail: "Blizzard is refusing requests, try again later", Err: err}
+	case "timeout", "network", "decode":
+		return &apiError{Status: http.StatusBadGateway, Code: codeUpstreamUnavailable, Detail: "Unable to retrieve stats from Blizzard", Err: err}
+	}
+
+	return &apiError{Status: http.StatusInternalServerError, Code: codeInternal, Detail: "Internal error", Err: err}
+}
+
+// newProblem creates the problem served for e.
+func newProblem(e *apiError) *problemObject {
+	return &problemObject{
+		Type:   "about:blank",
+		Title:  http.StatusText(e.Status),
+		Status: e.Status,
+		Detail: e.Detail,
+		Code:   e.Code,
+		Error:  e.Detail,
+	}
+}
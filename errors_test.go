@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ow-api/ovrstat/ovrstat"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_ToAPIError(t *testing.T) {
+	blocked := fmt.Errorf("Failed to perform platform API request: %w", &upstreamStatusError{StatusCode: http.StatusForbidden})
+
+	var syntaxErr error = &json.SyntaxError{}
+
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ovrstat.ErrPlayerNotFound, http.StatusNotFound, codeNotFound},
+		{errPlayerPrivate, http.StatusForbidden, codePrivate},
+		{errInvalidTag, http.StatusBadRequest, codeInvalidTag},
+		{blocked, http.StatusServiceUnavailable, codeUpstreamBlocked},
+		{context.DeadlineExceeded, http.StatusBadGateway, codeUpstreamUnavailable},
+		{syntaxErr, http.StatusBadGateway, codeUpstreamUnavailable},
+		{errors.New("add operation does not apply"), http.StatusInternalServerError, codeInternal},
+	}
+
+	for _, test := range tests {
+		apiErr := toAPIError(test.err)
+
+		if apiErr.Status != test.status || apiErr.Code != test.code {
+			t.Errorf("Expected %v to be served as %d %s, got %d %s", test.err, test.status, test.code, apiErr.Status, apiErr.Code)
+		}
+	}
+}
+
+func Test_BlockDetectingTransport(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blocked" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	defer upstream.Close()
+
+	client := &http.Client{Transport: &blockDetectingTransport{next: http.DefaultTransport}}
+
+	_, err := client.Get(upstream.URL + "/blocked")
+
+	if class := upstreamErrorClass(err); class != "blocked" {
+		t.Fatal("Expected a blocked error, got", class, err)
+	}
+
+	// ovrstat relies on 404 responses to detect missing profiles
+	res, err := client.Get(upstream.URL + "/missing")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected the response to be passed through, got", res.StatusCode)
+	}
+}
+
+func Test_ProblemResponses(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	tests := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/v3/stats/pc/missing-0000/complete", http.StatusNotFound, codeNotFound},
+		{"/v3/stats/pc/not%20a%20tag!/complete", http.StatusBadRequest, codeInvalidTag},
+		{"/v3/stats/pc/broken-3456/profile", http.StatusBadGateway, codeUpstreamUnavailable},
+		{"/v3/stats/pc/cats-11481/heroes/ana,", http.StatusBadRequest, codeInvalidRequest},
+	}
+
+	for _, test := range tests {
+		res, m := getResponse(t, srv.URL+test.path, test.status)
+
+		if contentType := res.Header.Get("Content-Type"); contentType != problemContentType {
+			t.Errorf("Expected %s to be a problem, got %s", test.path, contentType)
+		}
+
+		if m["code"] != test.code || m["status"] != float64(test.status) || m["title"] != http.StatusText(test.status) {
+			t.Errorf("Expected %s to be %d %s, got %v", test.path, test.status, test.code, m)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"github.com/ow-api/ovrstat/ovrstat"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// StatsFetcher retrieves player stats from an upstream source.
+// Tags are passed in their BattleTag form (Name#1234). Fetches should stop once ctx is done.
+type StatsFetcher interface {
+	Stats(ctx context.Context, platform, tag string) (*ovrstat.PlayerStats, error)
+}
+
+// ovrstatFetcher scrapes stats from the Blizzard site using ovrstat.
+// ovrstat doesn't take a context, so a cancelled fetch stops waiting for the scrape but can't abort it,
+// the scrape is bounded by the timeout of http.DefaultClient instead.
+type ovrstatFetcher struct {
+}
+
+type ovrstatResult struct {
+	stats *ovrstat.PlayerStats
+	err   error
+}
+
+func (f *ovrstatFetcher) Stats(ctx context.Context, platform, tag string) (*ovrstat.PlayerStats, error) {
+	res := make(chan ovrstatResult, 1)
+
+	go func() {
+		stats, err := ovrstat.Stats(platform, tag)
+
+		res <- ovrstatResult{stats, err}
+	}()
+
+	select {
+	case r := <-res:
+		return r.stats, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var (
+	fetchGroup callGroup
+
+	upstreamFetches   = expvar.NewInt("upstreamFetches")
+	coalescedRequests = expvar.NewInt("coalescedRequests")
+)
+
+// fetchStats retrieves stats using statsFetcher, sharing a single upstream fetch
+// (and its result or error) between concurrent lookups of the same player.
+// The fetch is cancelled after upstreamTimeout, or once every lookup waiting for it is cancelled.
+func fetchStats(ctx context.Context, platform, tag string) (*ovrstat.PlayerStats, error) {
+	start := time.Now()
+
+	v, err, shared := fetchGroup.Do(ctx, platform+"-"+tag, func(ctx context.Context) (interface{}, error) {
+		upstreamFetches.Add(1)
+
+		if upstreamTimeout > 0 {
+			var cancel context.CancelFunc
+
+			ctx, cancel = context.WithTimeout(ctx, upstreamTimeout)
+			defer cancel()
+		}
+
+		start := time.Now()
+
+		ctx, span := startSpan(ctx, "ovrstat.Stats", attribute.String("player.platform", platform), attribute.String("player.tag", tag))
+
+		stats, err := statsFetcher.Stats(ctx, platform, tag)
+
+		endSpan(span, err)
+
+		observeUpstream(start, err)
+
+		// ovrstat stops at the search result for private players, leaving their name empty
+		if err == nil && stats.Private && stats.Name == "" {
+			stats.Name = tag
+		}
+
+		if err != nil && err != ovrstat.ErrPlayerNotFound {
+			// The call runs with the context of the request that started it, so its id is logged
+			requestLogger(ctx).Warn("Upstream fetch failed", "platform", platform, "tag", tag,
+				"class", upstreamErrorClass(err), "duration_ms", float64(time.Since(start).Microseconds())/1000, "error", err)
+		}
+
+		return stats, err
+	})
+
+	if shared {
+		coalescedRequests.Add(1)
+
+		trace.SpanFromContext(ctx).AddEvent("Joined an upstream fetch in flight")
+	}
+
+	requestInfoFrom(ctx).addUpstream(time.Since(start))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*ovrstat.PlayerStats), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ow-api/ovrstat/ovrstat"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fixtureFetcher serves recorded PlayerStats from dir/<platform>/<tag>.json,
+// with the tag in its URL form (Name-1234).
+type fixtureFetcher struct {
+	dir       string
+	calls     int64
+	cancelled int64
+
+	// gate, when set, blocks every fetch until it is closed.
+	gate chan struct{}
+}
+
+func newFixtureFetcher() *fixtureFetcher {
+	return &fixtureFetcher{dir: filepath.Join("testdata", "fixtures")}
+}
+
+func (f *fixtureFetcher) Stats(ctx context.Context, platform, tag string) (*ovrstat.PlayerStats, error) {
+	atomic.AddInt64(&f.calls, 1)
+
+	if f.gate != nil {
+		select {
+		case <-f.gate:
+		case <-ctx.Done():
+			atomic.AddInt64(&f.cancelled, 1)
+
+			return nil, ctx.Err()
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(f.dir, platform, strings.Replace(tag, "#", "-", -1)+".json"))
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ovrstat.ErrPlayerNotFound
+		}
+
+		return nil, err
+	}
+
+	var stats ovrstat.PlayerStats
+
+	if err := json.Unmarshal(b, &stats); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func (f *fixtureFetcher) Calls() int64 {
+	return atomic.LoadInt64(&f.calls)
+}
+
+func Test_FetchStatsCoalesced(t *testing.T) {
+	fetcher := newFixtureFetcher()
+	fetcher.gate = make(chan struct{})
+
+	oldFetcher := statsFetcher
+	statsFetcher = fetcher
+
+	defer func() {
+		statsFetcher = oldFetcher
+	}()
+
+	coalescedBefore := coalescedRequests.Value()
+
+	const lookups = 10
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, lookups)
+
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := fetchStats(context.Background(), ovrstat.PlatformPC, "missing#0000")
+
+			errs <- err
+		}()
+	}
+
+	// Give every lookup a chance to join the in-flight fetch
+	time.Sleep(50 * time.Millisecond)
+
+	close(fetcher.gate)
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != ovrstat.ErrPlayerNotFound {
+			t.Fatal("Expected every lookup to receive the shared error, got", err)
+		}
+	}
+
+	if calls := fetcher.Calls(); calls != 1 {
+		t.Fatalf("Expected a single upstream fetch, got %d", calls)
+	}
+
+	if coalesced := coalescedRequests.Value() - coalescedBefore; coalesced != lookups-1 {
+		t.Fatalf("Expected %d coalesced lookups, got %d", lookups-1, coalesced)
+	}
+}
+
+func Test_FetchStatsCancelled(t *testing.T) {
+	fetcher := newFixtureFetcher()
+	fetcher.gate = make(chan struct{})
+
+	oldFetcher := statsFetcher
+	statsFetcher = fetcher
+
+	defer func() {
+		statsFetcher = oldFetcher
+	}()
+
+	abandonedCtx, abandon := context.WithCancel(context.Background())
+
+	abandoned, waiting := make(chan error, 1), make(chan error, 1)
+
+	go func() {
+		_, err := fetchStats(abandonedCtx, ovrstat.PlatformPC, "cats#11481")
+
+		abandoned <- err
+	}()
+
+	go func() {
+		_, err := fetchStats(context.Background(), ovrstat.PlatformPC, "cats#11481")
+
+		waiting <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	abandon()
+
+	if err := <-abandoned; err != context.Canceled {
+		t.Fatal("Expected the abandoned lookup to be cancelled, got", err)
+	}
+
+	close(fetcher.gate)
+
+	// The fetch carries on for the lookup still waiting
+	if err := <-waiting; err != nil {
+		t.Fatal("Expected the remaining lookup to succeed, got", err)
+	}
+
+	fetcher.gate = make(chan struct{})
+	defer close(fetcher.gate)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := fetchStats(ctx, ovrstat.PlatformPC, "cats#11481"); err != context.DeadlineExceeded {
+		t.Fatal("Expected the lookup to time out, got", err)
+	}
+
+	// Once every lookup is gone, the upstream fetch itself is cancelled
+	for i := 0; atomic.LoadInt64(&fetcher.cancelled) == 0; i++ {
+		if i == 100 {
+			t.Fatal("Expected the upstream fetch to be cancelled")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if calls := fetcher.Calls(); calls != 2 {
+		t.Fatalf("Expected 2 upstream fetches, got %d", calls)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// callGroup runs a function once for concurrent callers sharing a key, like singleflight.
+// The function gets a context detached from any single caller, which is only cancelled
+// once every caller has given up waiting, so one abandoned request doesn't fail the others.
+type callGroup struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// Do runs fn for key unless a call is already in flight, and waits for its result or for ctx to be done.
+// shared reports whether the result came from a call started by another caller.
+func (g *callGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+
+	c, shared := g.calls[key]
+
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+		c = &call{done: make(chan struct{}), cancel: cancel}
+
+		g.calls[key] = c
+
+		go g.run(callCtx, key, c, fn)
+	}
+
+	c.waiters++
+
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err, shared
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+
+	c.waiters--
+
+	if c.waiters == 0 {
+		// Nobody is waiting anymore, new callers start over instead of joining a cancelled call
+		c.cancel()
+
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+	}
+
+	g.mu.Unlock()
+
+	return nil, ctx.Err(), shared
+}
+
+func (g *callGroup) run(ctx context.Context, key string, c *call, fn func(ctx context.Context) (interface{}, error)) {
+	defer func() {
+		// fn runs outside of the request goroutines, so a panic would otherwise take down the server
+		if r := recover(); r != nil {
+			requestLogger(ctx).Error("Recovered from panic", "key", key, "panic", r, "stack", string(debug.Stack()))
+
+			c.val, c.err = nil, fmt.Errorf("panic: %v", r)
+		}
+
+		g.mu.Lock()
+
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+
+		g.mu.Unlock()
+
+		c.cancel()
+
+		close(c.done)
+	}()
+
+	c.val, c.err = fn(ctx)
+}
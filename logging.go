@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	// maxRequestIDLength bounds the request ids accepted from clients and proxies
+	maxRequestIDLength = 128
+)
+
+var (
+	// logLevel is the minimum level logged, which changes when the configuration is reloaded
+	logLevel = new(slog.LevelVar)
+)
+
+// requestInfo collects what handlers learn about a request for its access log line.
+// Background work started by the request may still record to it after the line is written.
+type requestInfo struct {
+	id string
+
+	mu       sync.Mutex
+	traceID  string
+	platform string
+	tag      string
+	version  string
+	cache    string
+	upstream time.Duration
+}
+
+func (s cacheStatus) String() string {
+	switch s {
+	case cacheHit:
+		return "hit"
+	case cacheStale:
+		return "stale"
+	case cacheStaleError:
+		return "stale-error"
+	}
+
+	return "miss"
+}
+
+// parseLogLevel parses a level name such as debug, info, warn or error.
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", s)
+	}
+
+	return level, nil
+}
+
+// newLogHandler creates the handler writing logs to w in format, json or text.
+func newLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	switch format {
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	}
+
+	return nil, fmt.Errorf("invalid log format %q, expected json or text", format)
+}
+
+// setupLogging sends logs, including those of the log package, to stderr in format.
+func setupLogging(format string) error {
+	handler, err := newLogHandler(os.Stderr, format)
+
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
+
+// fatal logs msg along with err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+
+	os.Exit(1)
+}
+
+// requestInfoFrom returns the info of the request ctx belongs to, or nil outside of requests.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+
+	return info
+}
+
+// requestLogger returns the default logger, with the request id when ctx belongs to a request.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if info := requestInfoFrom(ctx); info != nil {
+		return slog.Default().With("request_id", info.id)
+	}
+
+	return slog.Default()
+}
+
+// setTrace records the trace of a request, when it is sampled.
+func (i *requestInfo) setTrace(sc trace.SpanContext) {
+	if i == nil || !sc.IsSampled() {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.traceID = sc.TraceID().String()
+}
+
+// setPlayer records the player and api version a request is for.
+func (i *requestInfo) setPlayer(platform, tag string, version ApiVersion) {
+	if i == nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.platform, i.tag, i.version = platform, tag, apiVersionName(version)
+}
+
+// setCache records how the cache answered the request.
+func (i *requestInfo) setCache(status cacheStatus) {
+	if i == nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.cache = status.String()
+}
+
+// addUpstream records time spent waiting for upstream fetches.
+func (i *requestInfo) addUpstream(d time.Duration) {
+	if i == nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.upstream += d
+}
+
+func (i *requestInfo) attrs() []interface{} {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	attrs := make([]interface{}, 0, 12)
+
+	if i.traceID != "" {
+		attrs = append(attrs, "trace_id", i.traceID)
+	}
+
+	if i.platform != "" {
+		attrs = append(attrs, "platform", i.platform, "tag", i.tag, "version", i.version)
+	}
+
+	if i.cache != "" {
+		attrs = append(attrs, "cache", i.cache)
+	}
+
+	if i.upstream > 0 {
+		attrs = append(attrs, "upstream_ms", float64(i.upstream.Microseconds())/1000)
+	}
+
+	return attrs
+}
+
+// validRequestID reports whether id, received from a client or proxy, is safe to reuse in logs and responses.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// logRequests gives every request an id, kept from the X-Request-ID header when valid and returned in it,
+// and writes an access log line once handler is done, with the route of the request in router.
+func logRequests(router *labelledRouter, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+
+		if !validRequestID(id) {
+			// Reading random bytes doesn't fail on supported platforms
+			id, _ = randomHex(16)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{id: id}
+
+		rec := &statusRecorder{ResponseWriter: w}
+
+		handler.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		attrs := []interface{}{
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", router.Label(r),
+			"status", rec.status,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+
+		slog.Log(r.Context(), level, "Request", append(attrs, info.attrs()...)...)
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of request goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lines := make([]map[string]interface{}, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+
+	for scanner.Scan() {
+		m := make(map[string]interface{})
+
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+
+		lines = append(lines, m)
+	}
+
+	return lines
+}
+
+func captureLogs(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+
+	handler, err := newLogHandler(buf, "json")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := slog.Default()
+
+	slog.SetDefault(slog.New(handler))
+
+	t.Cleanup(func() {
+		slog.SetDefault(old)
+	})
+
+	return buf
+}
+
+func getWithRequestID(t *testing.T, url, id string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	return res
+}
+
+func Test_RequestID(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	captureLogs(t)
+
+	if id := getWithRequestID(t, srv.URL+"/v3/version", "").Header.Get(requestIDHeader); len(id) != 32 {
+		t.Error("Expected a generated request id, got", id)
+	}
+
+	if id := getWithRequestID(t, srv.URL+"/v3/version", "edge-7f3a.1").Header.Get(requestIDHeader); id != "edge-7f3a.1" {
+		t.Error("Expected the request id to be kept, got", id)
+	}
+
+	if id := getWithRequestID(t, srv.URL+"/v3/version", "bad id\"").Header.Get(requestIDHeader); id == "bad id\"" || len(id) != 32 {
+		t.Error("Expected an invalid request id to be replaced, got", id)
+	}
+}
+
+func Test_AccessLog(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	logs := captureLogs(t)
+
+	getWithRequestID(t, srv.URL+"/v3/stats/pc/cats-11481/profile", "access-1")
+	getWithRequestID(t, srv.URL+"/v3/stats/pc/broken-3456/profile", "access-2")
+
+	var access map[string]interface{}
+
+	var upstreamFailure bool
+
+	for _, line := range logs.lines(t) {
+		switch {
+		case line["msg"] == "Request" && line["request_id"] == "access-1":
+			access = line
+		case line["msg"] == "Upstream fetch failed" && line["request_id"] == "access-2":
+			upstreamFailure = true
+		}
+	}
+
+	if access == nil {
+		t.Fatal("Expected an access log line for the request")
+	}
+
+	expected := map[string]interface{}{
+		"route":    "/v3/stats/:platform/:tag/profile",
+		"platform": "pc",
+		"tag":      "cats-11481",
+		"version":  "v3",
+		"cache":    "miss",
+		"status":   float64(http.StatusOK),
+	}
+
+	for key, value := range expected {
+		if access[key] != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value, access[key])
+		}
+	}
+
+	if _, exists := access["upstream_ms"]; !exists {
+		t.Error("Expected the upstream latency to be logged")
+	}
+
+	if !upstreamFailure {
+		t.Error("Expected the upstream failure to be logged with its request id")
+	}
+}
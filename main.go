@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,13 +10,19 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	"github.com/julienschmidt/httprouter"
 	"github.com/ow-api/ovrstat/ovrstat"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"github.com/stoewer/go-strcase"
-	"golang.org/x/net/context"
+	"go.opentelemetry.io/otel/attribute"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -28,12 +35,25 @@ const (
 
 type ApiVersion int
 
+type contextKey int
+
+const (
+	// versionKey holds the ApiVersion of a request in its context
+	versionKey contextKey = iota
+	// requestInfoKey holds the *requestInfo of a request in its context
+	requestInfoKey
+)
+
 const (
 	VersionOne ApiVersion = iota
 	VersionTwo
 	VersionThree
 )
 
+var (
+	apiVersions = []ApiVersion{VersionOne, VersionTwo, VersionThree}
+)
+
 type gamesStats struct {
 	Played int64 `json:"played"`
 	Won    int64 `json:"won"`
@@ -48,14 +68,70 @@ type awardsStats struct {
 }
 
 var (
+	flagConfig = flag.String("config", "", "YAML or TOML configuration file, with settings named after the flags in snake case (cache_time)")
+
 	flagBind      = flag.String("bind-address", ":8080", "Address to bind to for http requests")
 	flagCache     = flag.String("cache", "redis://localhost:6379", "Cache uri or 'none' to disable")
 	flagCacheTime = flag.Int("cacheTime", 300, "Cache time in seconds")
 
+	flagStaleWhileRevalidate = flag.Int("staleWhileRevalidate", 0, "Time in seconds an expired entry is served while it is refreshed in the background")
+	flagStaleIfError         = flag.Int("staleIfError", 0, "Time in seconds an expired entry is served when refreshing it fails")
+
+	flagUpstreamTimeout = flag.Int("upstreamTimeout", 30, "Time in seconds allowed for an upstream stats fetch, or 0 for no limit")
+	flagCacheTimeout    = flag.Int("cacheTimeout", 2, "Time in seconds allowed for each cache read and write made while serving a request, or 0 for no limit")
+
+	flagNegativeCacheTime = flag.Int("negativeCacheTime", 60, "Cache time in seconds for players not found or private, or 0 to disable")
+
+	flagAdminToken = flag.String("admin-token", "", "Bearer token for the admin api, or empty to disable it")
+
+	flagLogLevel  = flag.String("logLevel", "info", "Minimum level logged: debug, info, warn or error")
+	flagLogFormat = flag.String("logFormat", "json", "Log format: json or text")
+
+	flagTraceExporter   = flag.String("traceExporter", "", "Where traces are exported: otlp, stdout, or empty to disable tracing")
+	flagTraceEndpoint   = flag.String("traceEndpoint", "", "OTLP http endpoint url for traces, defaults to the OTEL_EXPORTER_OTLP_* environment variables")
+	flagTraceSampleRate = flag.Int("traceSampleRate", 100, "Percentage of new traces sampled")
+
+	flagCorsOrigins = flag.String("corsOrigins", "*", "Comma separated origins allowed to make cross-origin requests")
+
+	flagRateLimit      = flag.Int("rateLimit", 60, "Requests per minute allowed per anonymous client ip, or 0 to disable")
+	flagRateBurst      = flag.Int("rateBurst", 20, "Requests an anonymous client ip may make at once before being rate limited")
+	flagTrustedProxies = flag.String("trustedProxies", "", "Comma separated ips and cidr ranges of proxies trusted to set X-Forwarded-For")
+	flagAPIKeyHeader   = flag.String("apiKeyHeader", "X-API-Key", "Header carrying api keys")
+	flagAPIKeyStore    = flag.String("apiKeyStore", "", "Where api keys are stored, 'cache' to share them through a redis cache or the path of a file, or empty to disable api keys")
+	flagTiers          = flag.String("tiers", "free=120:30,sponsor=600:100", "Comma separated api key tiers with their requests per minute and burst")
+
+	flagReadTimeout     = flag.Int("readTimeout", 10, "Time in seconds allowed to read a request")
+	flagWriteTimeout    = flag.Int("writeTimeout", 60, "Time in seconds allowed to write a response, including upstream fetches")
+	flagIdleTimeout     = flag.Int("idleTimeout", 120, "Time in seconds idle keep-alive connections are kept open")
+	flagShutdownTimeout = flag.Int("shutdownTimeout", 30, "Time in seconds in-flight requests are given to finish on shutdown")
+
+	flagWatchlist          = flag.String("watchlist", "", "File listing players to keep warm in the cache, one platform and tag per line")
+	flagRefreshInterval    = flag.Int("refreshInterval", 240, "Time in seconds between refreshes of watched players, or 0 to disable")
+	flagRefreshJitter      = flag.Int("refreshJitter", 30, "Maximum random delay in seconds before each watched player is refreshed")
+	flagRefreshConcurrency = flag.Int("refreshConcurrency", 4, "Maximum number of watched players refreshed at once")
+
 	cacheProvider cache.Provider
 
+	statsFetcher StatsFetcher = &ovrstatFetcher{}
+
 	cacheTime time.Duration
 
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	negativeCacheTime time.Duration
+
+	upstreamTimeout time.Duration
+	cacheTimeout    time.Duration
+
+	adminToken string
+
+	watchedPlayers = &watchlist{players: make(map[string]*watchedPlayer)}
+
+	requestLimiter *rateLimiter
+
+	apiKeys *apiKeyManager
+
 	profilePatch *jsonpatch.Patch
 
 	heroNames []string
@@ -64,12 +140,167 @@ var (
 )
 
 func main() {
+	flag.Parse()
+
+	set := commandLineFlags(flag.CommandLine)
+
+	configFile := *flagConfig
+
+	if !set["config"] {
+		configFile = os.Getenv(configEnv("config"))
+	}
+
+	if err := applyConfig(flag.CommandLine, set, configFile, os.Environ()); err != nil {
+		log.Fatalln("Unable to load configuration:", err)
+	}
+
+	if err := validateConfig(flag.CommandLine); err != nil {
+		log.Fatalln("Invalid configuration:", err)
+	}
+
+	if err := setupLogging(*flagLogFormat); err != nil {
+		log.Fatalln("Unable to set up logging:", err)
+	}
+
+	tracerProvider, err := setupTracing(context.Background(), *flagTraceExporter, *flagTraceEndpoint, *flagTraceSampleRate)
+
+	if err != nil {
+		fatal("Unable to set up tracing", err)
+	}
+
+	upstreamTimeout = time.Duration(*flagUpstreamTimeout) * time.Second
+	cacheTimeout = time.Duration(*flagCacheTimeout) * time.Second
+
+	// ovrstat scrapes through http.DefaultClient, this bounds scrapes that can't be cancelled
+	http.DefaultClient.Timeout = upstreamTimeout
+
+	// and this tells blocked scrapes apart from pages ovrstat fails to parse
+	http.DefaultClient.Transport = &blockDetectingTransport{next: http.DefaultTransport}
+
 	loadHeroNames()
 
-	cacheProvider = cache.ForURI(*flagCache)
+	provider, err := cache.ForURI(*flagCache)
+
+	if err != nil {
+		fatal("Unable to create cache", err)
+	}
+
+	cacheProvider = withMetrics(provider, *flagCache)
+
+	adminToken = *flagAdminToken
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *flagAPIKeyStore != "" {
+		store, err := newAPIKeyStore(*flagAPIKeyStore)
+
+		if err != nil {
+			fatal("Unable to load api keys", err)
+		}
+
+		apiKeys = newAPIKeyManager(store, nil)
+
+		go apiKeys.runUsageFlusher(ctx, time.Minute)
+	}
+
+	// Always created, so reloading the configuration can enable rate limiting
+	requestLimiter = newRateLimiter(rateLimit{}, *flagAPIKeyHeader, apiKeys, nil)
+
+	applySettings(flag.CommandLine)
+
+	hup := make(chan os.Signal, 1)
+
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if err := reloadConfig(flag.CommandLine, set, configFile); err != nil {
+				slog.Error("Unable to reload configuration, keeping the current one", "error", err)
+				continue
+			}
+
+			slog.Info("Reloaded configuration")
+		}
+	}()
+
+	watchedPlayers, err = newWatchlist(*flagWatchlist)
+
+	if err != nil {
+		fatal("Unable to load watchlist", err)
+	}
+
+	if *flagRefreshInterval > 0 && *flagCacheTime > 0 {
+		go watchedPlayers.runWarmer(ctx, warmerOptions{
+			interval:    time.Duration(*flagRefreshInterval) * time.Second,
+			jitter:      time.Duration(*flagRefreshJitter) * time.Second,
+			concurrency: *flagRefreshConcurrency,
+		})
+	}
+
+	srv := &http.Server{
+		Handler:           newRouter(),
+		ReadHeaderTimeout: time.Duration(*flagReadTimeout) * time.Second,
+		ReadTimeout:       time.Duration(*flagReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(*flagWriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(*flagIdleTimeout) * time.Second,
+	}
+
+	ln, err := net.Listen("tcp", *flagBind)
+
+	if err != nil {
+		fatal("Unable to listen", err)
+	}
+
+	if err := serve(ctx, srv, ln, time.Duration(*flagShutdownTimeout)*time.Second); err != nil {
+		slog.Error("Unable to shut down cleanly", "error", err)
+	}
+
+	if apiKeys != nil {
+		if err := apiKeys.FlushUsage(); err != nil {
+			slog.Error("Unable to record api key usage", "error", err)
+		}
+	}
+
+	if err := cache.Close(cacheProvider); err != nil {
+		slog.Error("Unable to close cache", "error", err)
+	}
+
+	if tracerProvider != nil {
+		// Flush the spans still batched
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := tracerProvider.Shutdown(flushCtx); err != nil {
+			slog.Error("Unable to export remaining traces", "error", err)
+		}
+	}
+}
+
+// serve handles requests on ln until ctx is done, then stops accepting connections
+// and waits up to timeout for in-flight requests to finish.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration) error {
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, waiting for in-flight requests")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	cacheTime = time.Duration(*flagCacheTime) * time.Second
+	return srv.Shutdown(shutdownCtx)
+}
 
+func init() {
 	var err error
 
 	ops := []patchOperation{
@@ -84,18 +315,28 @@ func main() {
 	if err != nil {
 		log.Fatalln("Unable to create base patch:", err)
 	}
+}
 
-	router := httprouter.New()
+func newRouter() http.Handler {
+	router := newLabelledRouter()
 
 	router.HEAD("/status", statusHandler)
 	router.GET("/status", statusHandler)
 
+	router.Handler(http.MethodGet, "/metrics", promhttp.Handler())
+
 	registerVersionOne(router)
 
 	registerVersionTwo(router)
 
+	if adminToken != "" {
+		registerAdmin(router)
+	}
+
 	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
+		AllowedOrigins: splitList(*flagCorsOrigins),
+		AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "If-None-Match", "If-Modified-Since", requestIDHeader, *flagAPIKeyHeader},
+		ExposedHeaders: []string{"RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "ETag", "Warning", requestIDHeader},
 	})
 
 	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -104,10 +345,16 @@ func main() {
 		}
 	})
 
-	log.Fatal(http.ListenAndServe(*flagBind, c.Handler(router)))
+	handler := http.Handler(router)
+
+	if requestLimiter != nil {
+		handler = requestLimiter.Handler(router, handler)
+	}
+
+	return logRequests(router, traceRequests(router, c.Handler(instrumentRouter(router, handler))))
 }
 
-func registerVersionOne(router *httprouter.Router) {
+func registerVersionOne(router *labelledRouter) {
 	for _, platform := range platforms {
 		router.GET("/v1/stats/"+platform+"/:region/:tag/heroes/:heroes", injectPlatform(platform, heroes))
 		router.GET("/v1/stats/"+platform+"/:region/:tag/profile", injectPlatform(platform, profile))
@@ -121,7 +368,7 @@ func registerVersionOne(router *httprouter.Router) {
 	router.GET("/v1/status", statusHandler)
 }
 
-func registerVersionTwo(router *httprouter.Router) {
+func registerVersionTwo(router *labelledRouter) {
 	for _, platform := range platforms {
 		router.GET("/v2/stats/"+platform+"/:tag/heroes/:heroes", injectPlatform(platform, heroes))
 		router.GET("/v2/stats/"+platform+"/:tag/profile", injectPlatform(platform, profile))
@@ -140,6 +387,7 @@ func loadHeroNames() {
 	res, err := http.Get("https://overwatch.blizzard.com/en-us/heroes/")
 
 	if err != nil {
+		slog.Warn("Unable to load heroes", "error", err)
 		return
 	}
 
@@ -148,6 +396,7 @@ func loadHeroNames() {
 	doc, err := goquery.NewDocumentFromReader(res.Body)
 
 	if err != nil {
+		slog.Warn("Unable to load heroes", "error", err)
 		return
 	}
 
@@ -165,7 +414,8 @@ func loadHeroNames() {
 		heroNames = append(heroNames, strcase.LowerCamelCase(val))
 	})
 
-	log.Println("Loaded heroes", heroNames)
+	slog.Info("Loaded heroes", "count", len(heroNames))
+	slog.Debug("Loaded heroes", "heroes", heroNames)
 }
 
 var (
@@ -178,9 +428,11 @@ func injectPlatform(platform string, handler httprouter.Handle) httprouter.Handl
 			platform = ovrstat.PlatformConsole
 		}
 
+		normalizeTagParam(ps)
+
 		ps = append(ps, httprouter.Param{Key: "platform", Value: platform})
 
-		ctx := context.Background()
+		ctx := r.Context()
 
 		m := versionRegexp.FindStringSubmatch(r.RequestURI)
 
@@ -194,49 +446,206 @@ func injectPlatform(platform string, handler httprouter.Handle) httprouter.Handl
 				version = VersionThree
 			}
 
-			ctx = context.WithValue(ctx, "version", version)
+			ctx = context.WithValue(ctx, versionKey, version)
+		}
+
+		r = r.WithContext(ctx)
+
+		requestInfoFrom(ctx).setPlayer(platform, ps.ByName("tag"), requestVersion(r))
+
+		if !validTag(ps.ByName("tag")) {
+			writeError(w, errInvalidTag)
+			return
 		}
 
-		handler(w, r.WithContext(ctx), ps)
+		handler(w, r, ps)
+	}
+}
+
+// normalizeTagParam replaces the tag in ps with its URL form, returning it, or an empty string without a tag.
+func normalizeTagParam(ps httprouter.Params) string {
+	for i := range ps {
+		if ps[i].Key == "tag" {
+			ps[i].Value = normalizeTag(ps[i].Value)
+
+			return ps[i].Value
+		}
 	}
+
+	return ""
 }
 
-func statsResponse(w http.ResponseWriter, r *http.Request, ps httprouter.Params, patch *jsonpatch.Patch) ([]byte, error) {
-	var stats *ovrstat.PlayerStats
+// statsResponse returns the full response for the player, filtered by patch and cached under key when a patch is given.
+// Private players get their masthead with private set, or a 403 Forbidden with ?private=error.
+func statsResponse(w http.ResponseWriter, r *http.Request, ps httprouter.Params, key string, patch *jsonpatch.Patch) ([]byte, error) {
+	var entry *cache.Entry
+	var status cacheStatus
 	var err error
 
-	version := VersionOne
+	ctx, span := startSpan(r.Context(), "statsResponse",
+		attribute.String("player.platform", ps.ByName("platform")),
+		attribute.String("player.tag", ps.ByName("tag")),
+		attribute.Bool("filtered", patch != nil),
+	)
+
+	defer span.End()
+
+	r = r.WithContext(ctx)
 
-	if v := r.Context().Value("version"); v != nil {
-		version = v.(ApiVersion)
+	if patch == nil {
+		key = generateCacheKey(r, ps)
+
+		entry, status, err = statsEntry(r, ps)
+	} else {
+		entry, status, err = cachedEntry(r.Context(), key, func(ctx context.Context) (*cache.Entry, error) {
+			base, _, err := statsEntry(r.WithContext(ctx), ps)
+
+			if err != nil {
+				return nil, err
+			}
+
+			// Negative entries have no stats to filter
+			if base.Kind == entryNotFound || base.Kind == entryPrivate {
+				return base, nil
+			}
+
+			// Apply filter patch
+			_, applySpan := startSpan(ctx, "patch.apply", attribute.String("patch.stage", "filter"))
+
+			b, err := patch.Apply(base.Data)
+
+			endSpan(applySpan, err)
+
+			if err != nil {
+				patchFailures.WithLabelValues("filter").Inc()
+				requestLogger(ctx).Error("Unable to apply filter patch", "key", key, "error", err)
+				return nil, err
+			}
+
+			// Filtered responses expire along with the full response they came from
+			return &cache.Entry{Data: b, Kind: base.Kind, FreshUntil: base.FreshUntil, StaleUntil: base.StaleUntil, Modified: base.Modified}, nil
+		})
 	}
 
-	tag := ps.ByName("tag")
+	if err != nil {
+		spanError(span, err)
+		return nil, err
+	}
 
-	tag = strings.Replace(tag, "#", "-", -1)
+	span.SetAttributes(attribute.String("cache.status", status.String()))
+
+	requestInfoFrom(r.Context()).setCache(status)
+
+	if entry.Kind == entryNotFound {
+		return nil, ovrstat.ErrPlayerNotFound
+	}
+
+	if entry.Kind == entryPrivate && r.URL.Query().Get("private") == privateAsError {
+		return nil, errPlayerPrivate
+	}
+
+	writeCacheHeaders(w, entry, status)
+
+	return entry.Data, nil
+}
 
-	cacheKey := generateCacheKey(r, ps)
+// statsEntry returns the cached full response for the player, fetching and transforming the stats on a miss.
+func statsEntry(r *http.Request, ps httprouter.Params) (*cache.Entry, cacheStatus, error) {
+	version := requestVersion(r)
 
 	platform := ps.ByName("platform")
 
-	stats, err = ovrstat.Stats(platform, strings.Replace(tag, "-", "#", -1))
+	tag := strings.Replace(ps.ByName("tag"), "-", "#", -1)
+
+	// Caching of full response for modification
+	return cachedEntry(r.Context(), generateCacheKey(r, ps), func(ctx context.Context) (*cache.Entry, error) {
+		stats, err := fetchStats(ctx, platform, tag)
+
+		return newStatsEntry(ctx, stats, err, version)
+	})
+}
+
+// newStatsEntry creates the entry cached for the result of a fetch.
+// Players that don't exist or are private are cached as negative entries.
+func newStatsEntry(ctx context.Context, stats *ovrstat.PlayerStats, err error, version ApiVersion) (*cache.Entry, error) {
+	if err == ovrstat.ErrPlayerNotFound {
+		return newNegativeEntry(entryNotFound, nil), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if stats.Private {
+		b, err := json.Marshal(newPrivateProfile(stats))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return newNegativeEntry(entryPrivate, b), nil
+	}
+
+	b, err := transformStats(ctx, stats, version)
 
 	if err != nil {
 		return nil, err
 	}
 
-	// Caching of full response for modification
+	return &cache.Entry{Data: b}, nil
+}
+
+// privateProfile is the response for private players, with only the masthead of their public page.
+// The namecard isn't included, as ovrstat doesn't scrape it.
+type privateProfile struct {
+	Private         bool   `json:"private"`
+	Name            string `json:"name"`
+	Icon            string `json:"icon"`
+	Endorsement     int    `json:"endorsement"`
+	EndorsementIcon string `json:"endorsementIcon"`
+}
+
+func newPrivateProfile(stats *ovrstat.PlayerStats) *privateProfile {
+	return &privateProfile{
+		Private:         true,
+		Name:            stats.Name,
+		Icon:            stats.Icon,
+		Endorsement:     stats.Endorsement,
+		EndorsementIcon: stats.EndorsementIcon,
+	}
+}
+
+// refreshStats fetches the player's stats and replaces the full response cached for every api version.
+// Filtered responses are removed, so they are created again from the new stats.
+func refreshStats(ctx context.Context, platform, tag string) error {
+	stats, fetchErr := fetchStats(ctx, platform, strings.Replace(tag, "-", "#", -1))
 
-	res, err := cacheProvider.Get(cacheKey)
+	for _, version := range apiVersions {
+		entry, err := newStatsEntry(ctx, stats, fetchErr, version)
 
-	if res != nil && err == nil {
-		if patch != nil {
-			res, err = patch.Apply(res)
+		if err != nil {
+			return err
+		}
+
+		key := cacheKey(version, platform, tag)
+
+		if _, err := purgeFilteredEntries(key); err != nil {
+			return err
 		}
 
-		return res, err
+		_, err = fillEntry(ctx, key, func(ctx context.Context) (*cache.Entry, error) {
+			return entry, nil
+		})
+
+		if err != nil {
+			return err
+		}
 	}
 
+	return fetchErr
+}
+
+// transformStats encodes stats into the full response for the given api version,
+// adding the games summaries and version specific structures.
+func transformStats(ctx context.Context, stats *ovrstat.PlayerStats, version ApiVersion) ([]byte, error) {
 	extra := make([]patchOperation, 0)
 
 	if hs, ok := stats.QuickPlayStats.CareerStats["allHeroes"]; ok {
@@ -292,49 +701,67 @@ func statsResponse(w http.ResponseWriter, r *http.Request, ps httprouter.Params,
 		}
 	}
 
+	_, marshalSpan := startSpan(ctx, "json.marshal")
+
 	b, err := json.Marshal(stats)
 
+	endSpan(marshalSpan, err)
+
 	if err != nil {
 		return nil, err
 	}
 
 	if len(extra) > 0 {
+		_, buildSpan := startSpan(ctx, "patch.build", attribute.Int("patch.operations", len(extra)))
+
 		extraPatch, err := patchFromOperations(extra)
 
+		endSpan(buildSpan, err)
+
 		if err != nil {
+			patchFailures.WithLabelValues("transform").Inc()
+			requestLogger(ctx).Error("Unable to create transform patch", "player", stats.Name, "error", err)
 			return nil, err
 		}
 
+		_, applySpan := startSpan(ctx, "patch.apply", attribute.String("patch.stage", "transform"))
+
 		b, err = extraPatch.Apply(b)
 
+		endSpan(applySpan, err)
+
 		if err != nil {
+			patchFailures.WithLabelValues("transform").Inc()
+			requestLogger(ctx).Error("Unable to apply transform patch", "player", stats.Name, "error", err)
 			return nil, err
 		}
 	}
 
-	// Cache response
-	if cacheTime > 0 {
-		cacheProvider.Set(cacheKey, b, cacheTime)
-	}
+	return b, nil
+}
 
-	if patch != nil {
-		// Apply filter patch
-		b, err = patch.Apply(b)
+// requestVersion returns the api version of the request, as set by injectPlatform.
+func requestVersion(r *http.Request) ApiVersion {
+	if version, ok := r.Context().Value(versionKey).(ApiVersion); ok {
+		return version
 	}
 
-	return b, err
+	return VersionOne
 }
 
 func generateCacheKey(r *http.Request, ps httprouter.Params) string {
-	version := VersionOne
-
-	if v := r.Context().Value("version"); v != nil {
-		version = v.(ApiVersion)
-	}
+	return cacheKey(requestVersion(r), ps.ByName("platform"), ps.ByName("tag"))
+}
 
-	return versionToString(version) + "-" + ps.ByName("platform") + "-" + ps.ByName("tag")
+func cacheKey(version ApiVersion, platform, tag string) string {
+	return versionToString(version) + "-" + platform + "-" + tag
 }
 
 func versionToString(version ApiVersion) string {
 	return fmt.Sprintf("v%d", version)
 }
+
+// apiVersionName returns the version as used in request paths.
+func apiVersionName(version ApiVersion) string {
+	return fmt.Sprintf("v%d", version+1)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_ServeGracefulShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("done"))
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	served := make(chan error, 1)
+
+	go func() {
+		served <- serve(ctx, srv, ln, 5*time.Second)
+	}()
+
+	responses := make(chan int, 1)
+
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String())
+
+		if err != nil {
+			responses <- 0
+			return
+		}
+
+		res.Body.Close()
+
+		responses <- res.StatusCode
+	}()
+
+	<-started
+
+	cancel()
+
+	// Shutting down waits for the in-flight request
+	select {
+	case err := <-served:
+		t.Fatal("Expected serve to wait for the in-flight request, got", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	if status := <-responses; status != http.StatusOK {
+		t.Fatal("Expected the in-flight request to complete, got", status)
+	}
+
+	if err := <-served; err != nil {
+		t.Fatal("Expected a clean shutdown, got", err)
+	}
+
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatal("Expected the listener to be closed")
+	}
+}
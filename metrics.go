@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"git.meow.tf/ow-api/ow-api/cache"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ow-api/ovrstat/ovrstat"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "owapi_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "owapi_http_request_duration_seconds",
+		Help:    "HTTP request latencies by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	cacheOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "owapi_cache_operations_total",
+		Help: "Cache operations by provider, operation and result (hit, miss, ok or error).",
+	}, []string{"provider", "operation", "result"})
+
+	upstreamDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "owapi_upstream_request_duration_seconds",
+		Help:    "Latencies of upstream stats fetches.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "owapi_upstream_errors_total",
+		Help: "Failed upstream stats fetches by error class.",
+	}, []string{"class"})
+
+	patchFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "owapi_json_patch_failures_total",
+		Help: "JSON patches that could not be created or applied, by stage.",
+	}, []string{"stage"})
+)
+
+func init() {
+	// Expose the expvar counters, which aren't served on their own
+	prometheus.MustRegister(collectors.NewExpvarCollector(map[string]*prometheus.Desc{
+		"upstreamFetches":   prometheus.NewDesc("owapi_upstream_fetches_total", "Upstream stats fetches.", nil, nil),
+		"coalescedRequests": prometheus.NewDesc("owapi_coalesced_requests_total", "Lookups served by an upstream fetch already in flight.", nil, nil),
+		"cacheCompression":  prometheus.NewDesc("owapi_cache_compression", "Sizes of compressed cache values and their compression ratio.", []string{"stat"}, nil),
+	}))
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// instrumentRouter records the count and latency of requests handled by handler, labelled by their route in router.
+func instrumentRouter(router *labelledRouter, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		rec := &statusRecorder{ResponseWriter: w}
+
+		handler.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		route := router.Label(r)
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// labelledRouter is a router recording the route of every handler registered on it, so requests are labelled
+// by the route they matched, with platforms replaced by :platform (such as /v2/stats/:platform/:tag/complete).
+type labelledRouter struct {
+	*httprouter.Router
+
+	routes map[string][]labelledRoute
+}
+
+type labelledRoute struct {
+	segments []string
+	label    string
+}
+
+func newLabelledRouter() *labelledRouter {
+	return &labelledRouter{Router: httprouter.New(), routes: make(map[string][]labelledRoute)}
+}
+
+func (lr *labelledRouter) GET(path string, handle httprouter.Handle) {
+	lr.Handle(http.MethodGet, path, handle)
+}
+
+func (lr *labelledRouter) HEAD(path string, handle httprouter.Handle) {
+	lr.Handle(http.MethodHead, path, handle)
+}
+
+func (lr *labelledRouter) POST(path string, handle httprouter.Handle) {
+	lr.Handle(http.MethodPost, path, handle)
+}
+
+func (lr *labelledRouter) PUT(path string, handle httprouter.Handle) {
+	lr.Handle(http.MethodPut, path, handle)
+}
+
+func (lr *labelledRouter) DELETE(path string, handle httprouter.Handle) {
+	lr.Handle(http.MethodDelete, path, handle)
+}
+
+func (lr *labelledRouter) Handle(method, path string, handle httprouter.Handle) {
+	lr.Router.Handle(method, path, handle)
+	lr.record(method, path)
+}
+
+func (lr *labelledRouter) Handler(method, path string, handler http.Handler) {
+	lr.Router.Handler(method, path, handler)
+	lr.record(method, path)
+}
+
+func (lr *labelledRouter) record(method, path string) {
+	segments := strings.Split(path, "/")
+
+	label := make([]string, len(segments))
+
+	for i, segment := range segments {
+		label[i] = segment
+
+		if i > 0 && segments[i-1] == "stats" && validPlatform(segment) {
+			label[i] = ":platform"
+		}
+	}
+
+	lr.routes[method] = append(lr.routes[method], labelledRoute{segments: segments, label: strings.Join(label, "/")})
+}
+
+// Label returns the label of the route matching r, or unmatched.
+func (lr *labelledRouter) Label(r *http.Request) string {
+	if handle, _, _ := lr.Lookup(r.Method, r.URL.Path); handle == nil {
+		return "unmatched"
+	}
+
+	segments := strings.Split(r.URL.Path, "/")
+
+	for _, route := range lr.routes[r.Method] {
+		if route.matches(segments) {
+			return route.label
+		}
+	}
+
+	return "unmatched"
+}
+
+// matches reports whether the path split into segments matches the route, as the router would match it.
+func (route labelledRoute) matches(segments []string) bool {
+	for i, segment := range route.segments {
+		if strings.HasPrefix(segment, "*") {
+			return true
+		}
+
+		if i >= len(segments) {
+			return false
+		}
+
+		if strings.HasPrefix(segment, ":") {
+			if segments[i] == "" {
+				return false
+			}
+		} else if segment != segments[i] {
+			return false
+		}
+	}
+
+	return len(segments) == len(route.segments)
+}
+
+// metricsProvider counts the results of the operations of a cache provider.
+type metricsProvider struct {
+	cache.Provider
+	name string
+}
+
+// withMetrics wraps p to count its operations, labelled with the scheme of the cache uri.
+func withMetrics(p cache.Provider, uri string) cache.Provider {
+	name := uri
+
+	if u, err := url.Parse(uri); err == nil && u.Scheme != "" {
+		name = u.Scheme
+	}
+
+	return &metricsProvider{Provider: p, name: name}
+}
+
+func (p *metricsProvider) observe(operation string, err error, found bool) {
+	result := "ok"
+
+	switch {
+	case err == cache.ErrNotFound:
+		result = "miss"
+	case err != nil && err != cache.ErrNotSupported:
+		result = "error"
+	case found:
+		result = "hit"
+	}
+
+	cacheOperations.WithLabelValues(p.name, operation, result).Inc()
+}
+
+func (p *metricsProvider) Get(key string) ([]byte, error) {
+	b, err := p.Provider.Get(key)
+
+	p.observe("get", err, err == nil)
+
+	return b, err
+}
+
+func (p *metricsProvider) Set(key string, b []byte, d time.Duration) error {
+	err := p.Provider.Set(key, b, d)
+
+	p.observe("set", err, false)
+
+	return err
+}
+
+func (p *metricsProvider) Delete(key string) error {
+	err := p.Provider.Delete(key)
+
+	p.observe("delete", err, false)
+
+	return err
+}
+
+func (p *metricsProvider) GetMulti(keys []string) (map[string][]byte, error) {
+	m, err := p.Provider.GetMulti(keys)
+
+	if err != nil {
+		p.observe("get_multi", err, false)
+
+		return m, err
+	}
+
+	cacheOperations.WithLabelValues(p.name, "get_multi", "hit").Add(float64(len(m)))
+	cacheOperations.WithLabelValues(p.name, "get_multi", "miss").Add(float64(len(keys) - len(m)))
+
+	return m, nil
+}
+
+func (p *metricsProvider) SetMulti(items map[string][]byte, d time.Duration) error {
+	err := p.Provider.SetMulti(items, d)
+
+	p.observe("set_multi", err, false)
+
+	return err
+}
+
+// Close closes the wrapped provider.
+func (p *metricsProvider) Close() error {
+	return cache.Close(p.Provider)
+}
+
+// upstreamErrorClass groups upstream errors into a small set of labels.
+func upstreamErrorClass(err error) string {
+	var netErr net.Error
+	var statusErr *upstreamStatusError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case err == ovrstat.ErrPlayerNotFound:
+		return "not_found"
+	case errors.As(err, &statusErr):
+		return "blocked"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return "decode"
+	}
+
+	return "other"
+}
+
+// observeUpstream records the latency and outcome of an upstream fetch started at start.
+func observeUpstream(start time.Time, err error) {
+	upstreamDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		upstreamErrors.WithLabelValues(upstreamErrorClass(err)).Inc()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Metrics(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	cacheProvider = withMetrics(newTestCache(t, "gcache://?size=16"), "gcache://?size=16")
+	cacheTime = time.Minute
+
+	getJSON(t, srv.URL+"/v2/stats/pc/cats-11481/complete", http.StatusOK)
+	getJSON(t, srv.URL+"/v2/stats/pc/cats-11481/complete", http.StatusOK)
+	getJSON(t, srv.URL+"/v1/stats/pc/us/cats-11481/heroes/ana", http.StatusOK)
+	getJSON(t, srv.URL+"/v3/stats/console/missing-0000/profile", http.StatusNotFound)
+
+	res, err := http.Get(srv.URL + "/metrics")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := string(b)
+
+	expected := []string{
+		`owapi_http_requests_total{code="200",method="GET",route="/v2/stats/:platform/:tag/complete"}`,
+		`owapi_http_requests_total{code="200",method="GET",route="/v1/stats/:platform/:region/:tag/heroes/:heroes"}`,
+		`owapi_http_requests_total{code="404",method="GET",route="/v3/stats/:platform/:tag/profile"}`,
+		`owapi_http_request_duration_seconds_count{method="GET",route="/v2/stats/:platform/:tag/complete"}`,
+		`owapi_cache_operations_total{operation="get",provider="gcache",result="hit"}`,
+		`owapi_cache_operations_total{operation="get",provider="gcache",result="miss"}`,
+		`owapi_upstream_errors_total{class="not_found"}`,
+		`owapi_upstream_request_duration_seconds_count`,
+		`owapi_upstream_fetches_total`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Error("Expected metrics to contain", line)
+		}
+	}
+}
+
+func Test_RouteLabel(t *testing.T) {
+	router := newLabelledRouter()
+
+	registerVersionTwo(router)
+
+	router.Handler(http.MethodGet, "/metrics", http.NotFoundHandler())
+
+	tests := map[string]string{
+		"/v3/stats/pc/cats-11481/profile":   "/v3/stats/:platform/:tag/profile",
+		"/v3/stats/pc/pc/profile":           "/v3/stats/:platform/:tag/profile",
+		"/v3/stats/console/stats/complete":  "/v3/stats/:platform/:tag/complete",
+		"/v2/stats/pc/heroes/heroes/ana":    "/v2/stats/:platform/:tag/heroes/:heroes",
+		"/v2/stats/pc/profile/heroes/pc":    "/v2/stats/:platform/:tag/heroes/:heroes",
+		"/metrics":                          "/metrics",
+		"/v3/stats/xbox/cats-11481/profile": "unmatched",
+	}
+
+	for path, expected := range tests {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+
+		if label := router.Label(req); label != expected {
+			t.Errorf("Expected %s to be labelled %s, got %s", path, expected, label)
+		}
+	}
+}
@@ -7,6 +7,8 @@ for arch in $(echo $ARCH | sed "s/,/ /g"); do
       -m "Tyler Stuyfzand <admin@meow.tf>" --vendor "Meow.tf" \
       --before-install packaging/scripts/preinst.deb \
       --after-install packaging/scripts/postinst.deb \
+      --config-files /etc/owapi/config.yaml \
       /build/owapi_linux_${arch}=/usr/bin/owapi \
-      packaging/owapi.service=/lib/systemd/system/owapi.service
+      packaging/owapi.service=/lib/systemd/system/owapi.service \
+      packaging/config.yaml=/etc/owapi/config.yaml
 done
\ No newline at end of file
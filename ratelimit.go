@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errRateLimited     = errors.New("rate limit exceeded")
+	errInvalidAPIKey   = errors.New("invalid api key")
+	errRouteNotAllowed = errors.New("route not allowed for this api key")
+)
+
+// rateLimit allows perMinute requests per minute on average, in bursts of up to burst requests.
+// A zero perMinute doesn't limit requests.
+type rateLimit struct {
+	perMinute int
+	burst     int
+}
+
+func (l rateLimit) perSecond() rate.Limit {
+	return rate.Limit(float64(l.perMinute) / 60)
+}
+
+// rateLimiter throttles requests with a token bucket per client, identified by its api key header
+// or its ip address. Requests forwarded by trusted proxies are attributed to the address they were forwarded for.
+// Requests with an api key use the limit of the key's tier, and anonymous requests the anonymous limit.
+type rateLimiter struct {
+	anonymous      rateLimit
+	keys           *apiKeyManager
+	keyHeader      string
+	trustedProxies []*net.IPNet
+
+	// mu guards the limits and proxies, which change when the configuration is reloaded, along with the clients
+	mu        sync.Mutex
+	clients   map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+// newRateLimiter creates a rate limiter, accepting no api keys when keys is nil.
+func newRateLimiter(anonymous rateLimit, keyHeader string, keys *apiKeyManager, trustedProxies []*net.IPNet) *rateLimiter {
+	return &rateLimiter{
+		anonymous:      anonymous,
+		keys:           keys,
+		keyHeader:      keyHeader,
+		trustedProxies: trustedProxies,
+		clients:        make(map[string]*rate.Limiter),
+		lastSweep:      time.Now(),
+	}
+}
+
+// Configure replaces the anonymous limit and the trusted proxies, starting every client over with a full bucket.
+func (l *rateLimiter) Configure(anonymous rateLimit, trustedProxies []*net.IPNet) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.anonymous, l.trustedProxies = anonymous, trustedProxies
+
+	l.clients = make(map[string]*rate.Limiter)
+}
+
+// parseTrustedProxies parses a comma separated list of ip addresses and cidr ranges.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+
+			bits := 8 * net.IPv6len
+
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// rateLimitExempt reports whether path is served without counting against rate limits.
+func rateLimitExempt(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || path == "/metrics"
+}
+
+// Handler rate limits requests to next, adding the RateLimit-* headers to responses
+// and rejecting requests over the limit with 429 Too Many Requests and a Retry-After header.
+// Api keys are only accepted for the routes of router they allow.
+func (l *rateLimiter) Handler(router *labelledRouter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		l.mu.Lock()
+		limit := l.anonymous
+		l.mu.Unlock()
+
+		client := "ip:" + l.clientIP(r)
+
+		if secret := r.Header.Get(l.keyHeader); secret != "" && l.keys != nil {
+			key, err := l.keys.Lookup(secret)
+
+			if err == errKeyNotFound {
+				// Invalid keys are charged to the client's address, so guessing keys is rate limited too
+				if limit.perMinute != 0 {
+					now := time.Now()
+
+					limiter := l.limiter(client, limit, now)
+
+					if !limiter.AllowN(now, 1) {
+						w.Header().Set("Retry-After", strconv.Itoa(secondsUntil(1-math.Max(limiter.TokensAt(now), 0), limit)))
+						writeErrorStatus(w, http.StatusTooManyRequests, errRateLimited)
+						return
+					}
+				}
+
+				writeErrorStatus(w, http.StatusUnauthorized, errInvalidAPIKey)
+				return
+			} else if err != nil {
+				writeErrorStatus(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			if !key.allows(router.Label(r)) {
+				writeErrorStatus(w, http.StatusForbidden, errRouteNotAllowed)
+				return
+			}
+
+			// Keys whose tier was removed fall back to the anonymous limit
+			if tierLimit, exists := l.keys.Tier(key.Tier); exists {
+				limit = tierLimit
+			}
+
+			client = "key:" + key.ID
+
+			l.keys.RecordUsage(key)
+		}
+
+		if limit.perMinute == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+
+		limiter := l.limiter(client, limit, now)
+
+		allowed := limiter.AllowN(now, 1)
+
+		tokens := math.Max(limiter.TokensAt(now), 0)
+
+		h := w.Header()
+
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=60;burst=%d", limit.perMinute, limit.burst))
+		h.Set("RateLimit-Limit", strconv.Itoa(limit.burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+		h.Set("RateLimit-Reset", strconv.Itoa(secondsUntil(float64(limit.burst)-tokens, limit)))
+
+		if !allowed {
+			h.Set("Retry-After", strconv.Itoa(secondsUntil(1-tokens, limit)))
+			writeErrorStatus(w, http.StatusTooManyRequests, errRateLimited)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// secondsUntil returns the whole seconds needed for limit to refill tokens.
+func secondsUntil(tokens float64, limit rateLimit) int {
+	if tokens <= 0 {
+		return 0
+	}
+
+	return int(math.Ceil(tokens / float64(limit.perSecond())))
+}
+
+// limiter returns the token bucket of client, creating it with limit when missing.
+func (l *rateLimiter) limiter(client string, limit rateLimit, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+
+	limiter, exists := l.clients[client]
+
+	if !exists {
+		limiter = rate.NewLimiter(limit.perSecond(), limit.burst)
+
+		l.clients[client] = limiter
+	}
+
+	return limiter
+}
+
+// sweep forgets the clients whose buckets have refilled, which are no different from new ones, with l.mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, limiter := range l.clients {
+		if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+			delete(l.clients, client)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+// clientIP returns the address of the client, walking X-Forwarded-For back from the closest hop
+// while the request came through trusted proxies.
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	l.mu.Lock()
+	proxies := l.trustedProxies
+	l.mu.Unlock()
+
+	if !trustedProxy(proxies, host) {
+		return host
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+
+		if hop == "" {
+			continue
+		}
+
+		if !trustedProxy(proxies, hop) {
+			return hop
+		}
+
+		host = hop
+	}
+
+	return host
+}
+
+func trustedProxy(proxies []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range proxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func rateLimitedRequest(t *testing.T, handler http.Handler, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/v3/stats/pc/cats-11481/profile", nil)
+
+	req.RemoteAddr = remoteAddr
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func Test_RateLimit(t *testing.T) {
+	keys := newAPIKeyManager(&fileKeyStore{
+		file:   filepath.Join(t.TempDir(), "keys.json"),
+		keys:   make(map[string]*apiKey),
+		byHash: make(map[string]string),
+	}, map[string]rateLimit{"sponsor": {perMinute: 600, burst: 5}})
+
+	sponsorKey, sponsor, err := keys.Create("sponsor", "sponsor", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profileOnly, _, err := keys.Create("profiles", "sponsor", []string{"/v2/*", "/v3/stats/:platform/:tag/complete"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, profileSecret, err := keys.Rotate(profileOnly.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := newRateLimiter(rateLimit{perMinute: 60, burst: 2}, "X-API-Key", keys, nil)
+
+	router := newLabelledRouter()
+
+	router.GET("/v3/stats/:platform/:tag/profile", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler := limiter.Handler(router, router)
+
+	for i, remaining := range []string{"1", "0"} {
+		rec := rateLimitedRequest(t, handler, "192.0.2.1:1234", nil)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to be allowed, got %d", i+1, rec.Code)
+		}
+
+		if rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != remaining {
+			t.Fatal("Unexpected rate limit headers", rec.Header())
+		}
+	}
+
+	rec := rateLimitedRequest(t, handler, "192.0.2.1:1234", nil)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected the third request to be limited, got", rec.Code)
+	}
+
+	if rec.Header().Get("Retry-After") != "1" || rec.Header().Get("RateLimit-Reset") != "2" {
+		t.Fatal("Unexpected retry headers", rec.Header())
+	}
+
+	if rec := rateLimitedRequest(t, handler, "192.0.2.2:1234", nil); rec.Code != http.StatusOK {
+		t.Fatal("Expected other clients to have their own limit, got", rec.Code)
+	}
+
+	key := http.Header{"X-Api-Key": []string{sponsor}}
+
+	if rec := rateLimitedRequest(t, handler, "192.0.2.1:1234", key); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "5" {
+		t.Fatal("Expected the api key to use its tier's limit, got", rec.Code, rec.Header())
+	}
+
+	if rec := rateLimitedRequest(t, handler, "192.0.2.1:1234", http.Header{"X-Api-Key": []string{profileSecret}}); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected the route to be forbidden for the api key, got", rec.Code)
+	}
+
+	unknown := http.Header{"X-Api-Key": []string{"unknown"}}
+
+	for i := 0; i < 2; i++ {
+		if rec := rateLimitedRequest(t, handler, "192.0.2.3:1234", unknown); rec.Code != http.StatusUnauthorized {
+			t.Fatal("Expected an unknown api key to be rejected, got", rec.Code)
+		}
+	}
+
+	if rec := rateLimitedRequest(t, handler, "192.0.2.3:1234", unknown); rec.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected unknown api keys to count against the client's limit, got", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	exempt := httptest.NewRecorder()
+
+	handler.ServeHTTP(exempt, req)
+
+	if exempt.Code != http.StatusNotFound || exempt.Header().Get("RateLimit-Limit") != "" {
+		t.Fatal("Expected metrics to be exempt, got", exempt.Code, exempt.Header())
+	}
+
+	if k, _ := keys.Get(sponsorKey.ID); k.Usage[time.Now().UTC().Format(usageMonthFormat)] != 1 {
+		t.Fatal("Expected the request to be recorded, got", k.Usage)
+	}
+}
+
+func Test_RateLimitClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 127.0.0.1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := newRateLimiter(rateLimit{}, "X-API-Key", nil, proxies)
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		expectedIP   string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"127.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"127.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.1.2.3", "198.51.100.7"},
+		{"127.0.0.1:1234", "10.1.2.3", "10.1.2.3"},
+		{"127.0.0.1:1234", "", "127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		req.RemoteAddr = test.remoteAddr
+
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+
+		if ip := limiter.clientIP(req); ip != test.expectedIP {
+			t.Errorf("Expected %s for %s forwarded for %q, got %s", test.expectedIP, test.remoteAddr, test.forwardedFor, ip)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatal("Expected an invalid cidr range to fail")
+	}
+}
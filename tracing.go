@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ow-api/ovrstat/ovrstat"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+)
+
+const (
+	tracerName = "git.meow.tf/ow-api/ow-api"
+)
+
+func init() {
+	// W3C trace context is propagated even without an exporter, so traces continue through this server
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// newTraceExporter creates the span exporter named by the -traceExporter flag: otlp, sending spans over
+// http to endpoint or the OTEL_EXPORTER_OTLP_* environment variables, or stdout. An empty name disables tracing.
+func newTraceExporter(ctx context.Context, name, endpoint string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "otlp":
+		opts := make([]otlptracehttp.Option, 0)
+
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+
+		return otlptracehttp.New(ctx, opts...)
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	}
+
+	return nil, fmt.Errorf("invalid trace exporter %q, expected otlp or stdout", name)
+}
+
+// newTracerProvider creates a provider sending sampleRate percent of new traces to exporter.
+// Requests continuing a trace follow the sampling decision of their parent.
+func newTracerProvider(exporter sdktrace.SpanExporter, sampleRate int) *sdktrace.TracerProvider {
+	res := resource.NewSchemaless(semconv.ServiceName("owapi"), semconv.ServiceVersion(Version))
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(float64(sampleRate)/100))),
+	)
+}
+
+// setupTracing exports traces as named by the -traceExporter flag, returning the provider to shut down
+// on exit, or nil when tracing is disabled.
+func setupTracing(ctx context.Context, name, endpoint string, sampleRate int) (*sdktrace.TracerProvider, error) {
+	exporter, err := newTraceExporter(ctx, name, endpoint)
+
+	if err != nil || exporter == nil {
+		return nil, err
+	}
+
+	tp := newTracerProvider(exporter, sampleRate)
+
+	otel.SetTracerProvider(tp)
+
+	return tp, nil
+}
+
+// startSpan starts a span of the stage name as a child of the span in ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// spanError marks span as failed with err, unless err is nil.
+// Players not found are an expected outcome rather than a failure.
+func spanError(span trace.Span, err error) {
+	if err == nil || err == ovrstat.ErrPlayerNotFound {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// endSpan ends span, marking it as failed with err, unless err is nil.
+func endSpan(span trace.Span, err error) {
+	spanError(span, err)
+
+	span.End()
+}
+
+// traceRequests starts a server span for every request, continuing the trace of its traceparent header,
+// named after the route of the request in router.
+func traceRequests(router *labelledRouter, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := router.Label(r)
+
+		ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+
+		defer span.End()
+
+		requestInfoFrom(ctx).setTrace(span.SpanContext())
+
+		rec := &statusRecorder{ResponseWriter: w}
+
+		handler.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
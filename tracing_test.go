@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"testing"
+)
+
+func setupTestTracing(t *testing.T) func() tracetest.SpanStubs {
+	exporter := tracetest.NewInMemoryExporter()
+
+	tp := newTracerProvider(exporter, 100)
+
+	old := otel.GetTracerProvider()
+
+	otel.SetTracerProvider(tp)
+
+	t.Cleanup(func() {
+		otel.SetTracerProvider(old)
+
+		tp.Shutdown(context.Background())
+	})
+
+	return func() tracetest.SpanStubs {
+		if err := tp.ForceFlush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		return exporter.GetSpans()
+	}
+}
+
+func Test_Tracing(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	spans := setupTestTracing(t)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v3/stats/pc/cats-11481/profile", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	names := make(map[string]bool)
+
+	for _, span := range spans() {
+		names[span.Name] = true
+
+		if traceID := span.SpanContext.TraceID().String(); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Expected %s to continue the incoming trace, got trace %s", span.Name, traceID)
+		}
+
+		if span.Name == "GET /v3/stats/:platform/:tag/profile" && span.Parent.SpanID().String() != "00f067aa0ba902b7" {
+			t.Error("Expected the server span to be a child of the incoming span, got", span.Parent.SpanID())
+		}
+	}
+
+	for _, name := range []string{"GET /v3/stats/:platform/:tag/profile", "statsResponse", "cache.get", "cache.fill", "ovrstat.Stats", "json.marshal", "patch.apply"} {
+		if !names[name] {
+			t.Errorf("Expected a %s span, got %v", name, names)
+		}
+	}
+}
+
+func Test_TracingUpstreamError(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	spans := setupTestTracing(t)
+
+	res, err := http.Get(srv.URL + "/v3/stats/pc/broken-3456/complete")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	for _, span := range spans() {
+		if span.Name == "ovrstat.Stats" {
+			if span.Status.Code != codes.Error {
+				t.Error("Expected the failed fetch to be marked as an error, got", span.Status.Code)
+			}
+
+			return
+		}
+	}
+
+	t.Error("Expected an ovrstat.Stats span")
+}
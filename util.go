@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	jsonpatch "git.meow.tf/ow-api/ow-api/json-patch"
-	"github.com/ow-api/ovrstat/ovrstat"
 	"net/http"
+	"os"
+	"path/filepath"
 )
 
 func valueOrDefault(m map[string]interface{}, key string, d int64) int64 {
@@ -14,6 +16,8 @@ func valueOrDefault(m map[string]interface{}, key string, d int64) int64 {
 			return v.(int64)
 		case int:
 			return int64(v.(int))
+		case float64:
+			return int64(v.(float64))
 		}
 	}
 	return d
@@ -41,18 +45,67 @@ func patchFromOperations(ops []patchOperation) (*jsonpatch.Patch, error) {
 	return &patch, nil
 }
 
-type errorObject struct {
-	Error string `json:"error"`
+// writeError serves err as a problem, with the status and code of its class.
+func writeError(w http.ResponseWriter, err error) {
+	writeProblem(w, toAPIError(err))
 }
 
-func writeError(w http.ResponseWriter, err error) {
-	w.Header().Set("Content-Type", "application/json")
+// writeErrorStatus serves err as a problem with status, showing its message to the client.
+func writeErrorStatus(w http.ResponseWriter, status int, err error) {
+	var apiErr *apiError
 
-	if err == ovrstat.ErrPlayerNotFound {
-		w.WriteHeader(http.StatusNotFound)
+	if errors.As(err, &apiErr) {
+		writeProblem(w, apiErr)
+		return
 	}
 
-	if err := json.NewEncoder(w).Encode(&errorObject{Error: err.Error()}); err != nil {
+	code, exists := statusCodes[status]
+
+	if !exists {
+		code = codeInternal
+	}
+
+	writeProblem(w, &apiError{Status: status, Code: code, Detail: err.Error()})
+}
+
+func writeProblem(w http.ResponseWriter, e *apiError) {
+	w.Header().Set("Content-Type", problemContentType)
+
+	w.WriteHeader(e.Status)
+
+	if err := json.NewEncoder(w).Encode(newProblem(e)); err != nil {
 		return
 	}
 }
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path,
+// so the file is never left half written.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidWatchlistLine = errors.New("expected a platform and a tag")
+)
+
+type watchedPlayer struct {
+	Platform    string     `json:"platform"`
+	Tag         string     `json:"tag"`
+	LastRefresh *time.Time `json:"lastRefresh,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// watchlist holds the players kept warm in the cache, saved to file when one is given.
+// The file lists a platform and a tag per line, such as "pc Cats-11481", with # starting comments.
+type watchlist struct {
+	file string
+
+	mu      sync.Mutex
+	players map[string]*watchedPlayer
+}
+
+type warmerOptions struct {
+	interval    time.Duration
+	jitter      time.Duration
+	concurrency int
+}
+
+// newWatchlist creates a watchlist, loading the players listed in file when it exists.
+func newWatchlist(file string) (*watchlist, error) {
+	w := &watchlist{file: file, players: make(map[string]*watchedPlayer)}
+
+	if file == "" {
+		return w, nil
+	}
+
+	f, err := os.Open(file)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return w, nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, errInvalidWatchlistLine)
+		}
+
+		if !validPlatform(fields[0]) {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, errInvalidPlatform)
+		}
+
+		if !validTag(normalizeTag(fields[1])) {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, errInvalidTag)
+		}
+
+		w.add(fields[0], fields[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// watchlistKey returns the key of a player, with the tag in its URL form (Name-1234).
+func watchlistKey(platform, tag string) (string, string) {
+	tag = normalizeTag(tag)
+
+	return platform + "/" + tag, tag
+}
+
+func (w *watchlist) add(platform, tag string) bool {
+	key, tag := watchlistKey(platform, tag)
+
+	if _, exists := w.players[key]; exists {
+		return false
+	}
+
+	w.players[key] = &watchedPlayer{Platform: platform, Tag: tag}
+
+	return true
+}
+
+// Add watches a player, returning false when it was already watched.
+func (w *watchlist) Add(platform, tag string) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.add(platform, tag) {
+		return false, nil
+	}
+
+	return true, w.save()
+}
+
+// Remove stops watching a player, returning false when it wasn't watched.
+func (w *watchlist) Remove(platform, tag string) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key, _ := watchlistKey(platform, tag)
+
+	if _, exists := w.players[key]; !exists {
+		return false, nil
+	}
+
+	delete(w.players, key)
+
+	return true, w.save()
+}
+
+// Players returns a copy of the watched players, sorted by platform and tag.
+func (w *watchlist) Players() []watchedPlayer {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.sortedPlayers()
+}
+
+// sortedPlayers returns the watched players sorted by platform and tag, with w.mu held.
+func (w *watchlist) sortedPlayers() []watchedPlayer {
+	players := make([]watchedPlayer, 0, len(w.players))
+
+	for _, p := range w.players {
+		players = append(players, *p)
+	}
+
+	sort.Slice(players, func(i, j int) bool {
+		if players[i].Platform != players[j].Platform {
+			return players[i].Platform < players[j].Platform
+		}
+
+		return players[i].Tag < players[j].Tag
+	})
+
+	return players
+}
+
+// save writes the players to the watchlist file, with w.mu held.
+func (w *watchlist) save() error {
+	if w.file == "" {
+		return nil
+	}
+
+	var b strings.Builder
+
+	// Players are written sorted, so the file only changes where players were added or removed
+	for _, p := range w.sortedPlayers() {
+		fmt.Fprintln(&b, p.Platform, p.Tag)
+	}
+
+	return writeFileAtomic(w.file, []byte(b.String()), 0600)
+}
+
+// refresh refreshes a watched player and records the outcome.
+func (w *watchlist) refresh(ctx context.Context, platform, tag string) error {
+	err := refreshStats(ctx, platform, tag)
+
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key, _ := watchlistKey(platform, tag)
+
+	if p, exists := w.players[key]; exists {
+		p.LastRefresh = &now
+		p.LastError = ""
+
+		if err != nil {
+			p.LastError = err.Error()
+		}
+	}
+
+	return err
+}
+
+// RefreshAll refreshes every watched player, each after a random delay of up to jitter
+// and with no more than concurrency refreshes running at once. Refreshes not yet started are skipped once ctx is done.
+func (w *watchlist) RefreshAll(ctx context.Context, jitter time.Duration, concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	for _, p := range w.Players() {
+		wg.Add(1)
+
+		go func(platform, tag string) {
+			defer wg.Done()
+
+			if jitter > 0 {
+				select {
+				case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			defer func() { <-sem }()
+
+			if err := w.refresh(ctx, platform, tag); err != nil {
+				slog.Warn("Unable to refresh watched player", "platform", platform, "tag", tag, "error", err)
+			}
+		}(p.Platform, p.Tag)
+	}
+
+	wg.Wait()
+}
+
+// runWarmer refreshes the watched players on start and then every interval, until ctx is done.
+func (w *watchlist) runWarmer(ctx context.Context, opts warmerOptions) {
+	for {
+		w.RefreshAll(ctx, opts.jitter, opts.concurrency)
+
+		select {
+		case <-time.After(opts.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
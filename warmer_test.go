@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Watchlist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "watchlist")
+
+	if err := os.WriteFile(file, []byte("# Leaderboard\npc Cats#11481\n\nconsole hidden-2345\npc Cats-11481\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newWatchlist(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	players := w.Players()
+
+	if len(players) != 2 || players[0].Platform != "console" || players[1].Tag != "Cats-11481" {
+		t.Fatal("Unexpected players", players)
+	}
+
+	if added, err := w.Add("pc", "missing-0000"); !added || err != nil {
+		t.Fatal("Expected the player to be added, got", added, err)
+	}
+
+	if added, _ := w.Add("pc", "missing#0000"); added {
+		t.Fatal("Expected the player to be watched already")
+	}
+
+	if removed, err := w.Remove("console", "hidden-2345"); !removed || err != nil {
+		t.Fatal("Expected the player to be removed, got", removed, err)
+	}
+
+	w, err = newWatchlist(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if players := w.Players(); len(players) != 2 || players[0].Tag != "Cats-11481" || players[1].Tag != "missing-0000" {
+		t.Fatal("Expected changes to be saved, got", players)
+	}
+
+	if b, _ := os.ReadFile(file); string(b) != "pc Cats-11481\npc missing-0000\n" {
+		t.Fatalf("Expected the players to be saved sorted, got %q", b)
+	}
+
+	if err := os.WriteFile(file, []byte("pc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newWatchlist(file); err == nil {
+		t.Fatal("Expected an error for an invalid line")
+	}
+
+	if err := os.WriteFile(file, []byte("pc not!a!tag\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newWatchlist(file); err == nil {
+		t.Fatal("Expected an error for an invalid tag")
+	}
+}
+
+func Test_WarmerRefreshAll(t *testing.T) {
+	srv, fetcher := setupTestServer(t)
+
+	cacheProvider = newTestCache(t, "gcache://?size=64")
+	cacheTime = time.Minute
+
+	w, _ := newWatchlist("")
+
+	w.Add("pc", "cats-11481")
+	w.Add("pc", "broken-3456")
+
+	w.RefreshAll(context.Background(), 10*time.Millisecond, 1)
+
+	for _, version := range apiVersions {
+		if _, err := cacheProvider.Get(cacheKey(version, "pc", "cats-11481")); err != nil {
+			t.Fatal("Expected the", apiVersionName(version), "response to be cached, got", err)
+		}
+	}
+
+	players := w.Players()
+
+	if players[0].LastError == "" || players[1].LastRefresh == nil || players[1].LastError != "" {
+		t.Fatal("Unexpected refresh results", players)
+	}
+
+	calls := fetcher.Calls()
+
+	getJSON(t, srv.URL+"/v1/stats/pc/us/cats-11481/complete", http.StatusOK)
+	getJSON(t, srv.URL+"/v3/stats/pc/cats-11481/profile", http.StatusOK)
+
+	if fetcher.Calls() != calls {
+		t.Fatal("Expected warmed responses to be served from the cache")
+	}
+}
+
+func Test_AdminWatchlist(t *testing.T) {
+	setupTestServer(t)
+
+	oldToken, oldWatched := adminToken, watchedPlayers
+	adminToken = "secret"
+	watchedPlayers, _ = newWatchlist("")
+
+	defer func() {
+		adminToken, watchedPlayers = oldToken, oldWatched
+	}()
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	if status := adminRequest(t, http.MethodPut, srv.URL+"/admin/watchlist/pc/cats-11481", "secret", nil); status != http.StatusCreated {
+		t.Fatal("Expected the player to be created, got", status)
+	}
+
+	if status := adminRequest(t, http.MethodPut, srv.URL+"/admin/watchlist/xbox/cats-11481", "secret", nil); status != http.StatusBadRequest {
+		t.Fatal("Expected an invalid platform, got", status)
+	}
+
+	if status := adminRequest(t, http.MethodPut, srv.URL+"/admin/watchlist/pc/foo%20bar", "secret", nil); status != http.StatusBadRequest {
+		t.Fatal("Expected an invalid tag, got", status)
+	}
+
+	var list adminWatchlistObject
+
+	adminRequest(t, http.MethodGet, srv.URL+"/admin/watchlist", "secret", &list)
+
+	if len(list.Players) != 1 || list.Players[0].Tag != "cats-11481" {
+		t.Fatal("Unexpected watchlist", list.Players)
+	}
+
+	if status := adminRequest(t, http.MethodDelete, srv.URL+"/admin/watchlist/pc/cats-11481", "secret", nil); status != http.StatusOK {
+		t.Fatal("Unexpected status", status)
+	}
+
+	if status := adminRequest(t, http.MethodDelete, srv.URL+"/admin/watchlist/pc/cats-11481", "secret", nil); status != http.StatusNotFound {
+		t.Fatal("Expected the player to be gone, got", status)
+	}
+}